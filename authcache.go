@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// maxAuthCacheEntries bounds the auth cache, expired entries
+// are dropped when it is full
+const maxAuthCacheEntries = 10000
+
+// authResult is a cached decision of an external auth backend
+type authResult struct {
+	valid      bool
+	attributes map[string]string
+	expires    time.Time
+}
+
+// authCache caches positive and negative decisions of external auth
+// backends with separate TTLs. A zero TTL disables caching for that kind.
+type authCache struct {
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	results map[[sha256.Size]byte]authResult
+}
+
+func newAuthCache(positiveTTL, negativeTTL time.Duration) *authCache {
+	return &authCache{
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		results:     make(map[[sha256.Size]byte]authResult),
+	}
+}
+
+// authCacheKey hashes the credentials so no plaintext passwords are kept in memory
+func authCacheKey(parts ...string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+func (c *authCache) get(key [sha256.Size]byte) (authResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.results[key]
+	if !ok || time.Now().After(result.expires) {
+		return authResult{}, false
+	}
+	return result, true
+}
+
+func (c *authCache) put(key [sha256.Size]byte, valid bool, attributes map[string]string) {
+	ttl := c.negativeTTL
+	if valid {
+		ttl = c.positiveTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.results) >= maxAuthCacheEntries {
+		for k, result := range c.results {
+			if now.After(result.expires) {
+				delete(c.results, k)
+			}
+		}
+		if len(c.results) >= maxAuthCacheEntries {
+			c.results = make(map[[sha256.Size]byte]authResult)
+		}
+	}
+	c.results[key] = authResult{valid: valid, attributes: attributes, expires: now.Add(ttl)}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the failure history, the oldest
+// histories are dropped first when it is full
+const maxTrackedClients = 10000
+
+// banState is the on-disk format of the active bans,
+// mapping client IPs to the ban expiry
+type banState struct {
+	Bans map[string]time.Time `json:"bans"`
+}
+
+// banTracker bans client IPs for banTime after maxFailures failed
+// logins within findTime, in the spirit of fail2ban. Active bans are
+// saved to statePath, when set, to survive restarts.
+type banTracker struct {
+	maxFailures int
+	findTime    time.Duration
+	banTime     time.Duration
+	statePath   string
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	bans     map[string]time.Time
+}
+
+// newBanTracker builds the tracker from the app params, loading
+// the bans still active from the state file
+func newBanTracker(cfg params) (*banTracker, error) {
+	b := &banTracker{
+		maxFailures: cfg.BanMaxFailures,
+		findTime:    cfg.BanFindTime,
+		banTime:     cfg.BanTime,
+		statePath:   cfg.BanStateFile,
+		failures:    make(map[string][]time.Time),
+		bans:        make(map[string]time.Time),
+	}
+	if b.statePath == "" {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(b.statePath)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state banState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for ip, expires := range state.Bans {
+		if expires.After(now) && net.ParseIP(ip) != nil {
+			b.bans[ip] = expires
+		}
+	}
+	if len(b.bans) > 0 {
+		log.Printf("[INFO] ban: Restored %d active bans from %s", len(b.bans), b.statePath)
+	}
+	return b, nil
+}
+
+// Banned reports whether the IP is currently banned
+func (b *banTracker) Banned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expires, ok := b.bans[ip.String()]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(b.bans, ip.String())
+		log.Printf("[INFO] ban: Ban of %s expired", ip)
+		return false
+	}
+	return true
+}
+
+// Failed records a failed login of the client, banning it once
+// it reaches maxFailures within findTime
+func (b *banTracker) Failed(remote net.Addr) {
+	tcp, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	ip := tcp.IP.String()
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.bans[ip]; ok {
+		return
+	}
+
+	var recent []time.Time
+	for _, t := range b.failures[ip] {
+		if now.Sub(t) < b.findTime {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < b.maxFailures {
+		if _, ok := b.failures[ip]; !ok && len(b.failures) >= maxTrackedClients {
+			b.prune(now)
+		}
+		b.failures[ip] = recent
+		return
+	}
+
+	delete(b.failures, ip)
+	b.bans[ip] = now.Add(b.banTime)
+	log.Printf("[WARN] ban: Banned %s for %v after %d failed logins", ip, b.banTime, len(recent))
+	b.save(now)
+}
+
+// prune drops failure histories outside the find time, or all
+// of them if every client failed recently
+func (b *banTracker) prune(now time.Time) {
+	for ip, failures := range b.failures {
+		if now.Sub(failures[len(failures)-1]) >= b.findTime {
+			delete(b.failures, ip)
+		}
+	}
+	if len(b.failures) >= maxTrackedClients {
+		b.failures = make(map[string][]time.Time)
+	}
+}
+
+// save writes the active bans to the state file, replacing it atomically
+func (b *banTracker) save(now time.Time) {
+	if b.statePath == "" {
+		return
+	}
+	state := banState{Bans: make(map[string]time.Time)}
+	for ip, expires := range b.bans {
+		if expires.After(now) {
+			state.Bans[ip] = expires
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Printf("[ERR] ban: Failed to encode state: %v", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.statePath), ".bans-*")
+	if err != nil {
+		log.Printf("[ERR] ban: Failed to save state: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), b.statePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("[ERR] ban: Failed to save state to %s: %v", b.statePath, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanTracker(t *testing.T) {
+	cfg := params{
+		BanMaxFailures: 3,
+		BanFindTime:    time.Minute,
+		BanTime:        time.Hour,
+		BanStateFile:   filepath.Join(t.TempDir(), "bans.json"),
+	}
+	bans, err := newBanTracker(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}
+	bans.Failed(client)
+	bans.Failed(client)
+	bans.Failed(other)
+	if bans.Banned(client.IP) {
+		t.Fatalf("banned too early")
+	}
+	bans.Failed(client)
+	if !bans.Banned(client.IP) {
+		t.Fatalf("expected ban")
+	}
+	if bans.Banned(other.IP) {
+		t.Fatalf("unexpected ban of other client")
+	}
+
+	// Bans survive a restart
+	restored, err := newBanTracker(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !restored.Banned(client.IP) || restored.Banned(other.IP) {
+		t.Fatalf("bans not restored: %v", restored.bans)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/serjs/socks5-server/go-socks5"
+)
+
+var (
+	errNoClientCert   = fmt.Errorf("No verified client certificate")
+	errClientNotAllow = fmt.Errorf("Client certificate does not match the allowed pattern")
+)
+
+// tlsConnectionState is implemented by TLS client connections
+type tlsConnectionState interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// ClientCertAuthenticator is used to authenticate clients by their verified
+// TLS client certificate. Without Next the certificate alone is enough to
+// log in, otherwise Next has to succeed as well.
+type ClientCertAuthenticator struct {
+	// AllowedPattern, if set, has to match the certificate subject,
+	// common name or one of its SANs
+	AllowedPattern *regexp.Regexp
+	// Next is an optional authenticator required in addition to the certificate
+	Next socks5.Authenticator
+	// Fallback is an optional authenticator for clients without a
+	// certificate, only used without Next
+	Fallback socks5.Authenticator
+}
+
+// newClientCertAuthenticator builds the client certificate authenticator
+// from the app params, creds is used for the password part if configured
+func newClientCertAuthenticator(cfg params, creds socks5.CredentialStore) (*ClientCertAuthenticator, error) {
+	if cfg.TLSPort == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_PORT")
+	}
+
+	a := &ClientCertAuthenticator{}
+	if cfg.TLSClientPattern != "" {
+		pattern, err := regexp.Compile(cfg.TLSClientPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_CLIENT_PATTERN: %v", err)
+		}
+		a.AllowedPattern = pattern
+	}
+
+	var userPass socks5.Authenticator
+	if creds != nil {
+		userPass = socks5.UserPassAuthenticator{Credentials: creds}
+	}
+	switch cfg.TLSClientAuth {
+	case "cert":
+		a.Fallback = userPass
+	case "cert+password":
+		if userPass == nil {
+			return nil, fmt.Errorf("TLS_CLIENT_AUTH cert+password requires proxy credentials")
+		}
+		a.Next = userPass
+	default:
+		return nil, fmt.Errorf("unsupported TLS_CLIENT_AUTH %q", cfg.TLSClientAuth)
+	}
+	return a, nil
+}
+
+func (a ClientCertAuthenticator) GetCode() uint8 {
+	if a.Next != nil {
+		return a.Next.GetCode()
+	}
+	return socks5.NoAuth
+}
+
+func (a ClientCertAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*socks5.AuthContext, error) {
+	identity, err := a.Verify(writer)
+	if err != nil && a.Next == nil && a.Fallback != nil {
+		return a.Fallback.Authenticate(reader, writer)
+	}
+	if err != nil {
+		socks5.NoAcceptableAuth(writer)
+		return nil, err
+	}
+
+	if a.Next == nil {
+		if _, err := (socks5.NoAuthAuthenticator{}).Authenticate(reader, writer); err != nil {
+			return nil, err
+		}
+		return certContext(identity), nil
+	}
+
+	authContext, err := a.Next.Authenticate(reader, writer)
+	if err != nil {
+		return nil, err
+	}
+	return addIdentity(authContext, identity), nil
+}
+
+// certContext returns the AuthContext of a client logged in by its
+// certificate alone, the common name is the Username
+func certContext(identity map[string]string) *socks5.AuthContext {
+	identity["Username"] = identity["CertCommonName"]
+	return &socks5.AuthContext{Method: socks5.NoAuth, Payload: identity}
+}
+
+// addIdentity adds the certificate identity to the AuthContext of a
+// password login, without replacing the Username or attributes
+func addIdentity(authContext *socks5.AuthContext, identity map[string]string) *socks5.AuthContext {
+	if authContext.Payload == nil {
+		authContext.Payload = make(map[string]string)
+	}
+	for k, v := range identity {
+		if _, ok := authContext.Payload[k]; !ok {
+			authContext.Payload[k] = v
+		}
+	}
+	return authContext
+}
+
+// Verify checks the client certificate of a TLS connection and returns
+// its identity as AuthContext payload
+func (a ClientCertAuthenticator) Verify(conn interface{}) (map[string]string, error) {
+	tlsConn, ok := conn.(tlsConnectionState)
+	if !ok {
+		return nil, errNoClientCert
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil, errNoClientCert
+	}
+
+	cert := state.PeerCertificates[0]
+	names := certNames(cert)
+	if a.AllowedPattern != nil && !matchAny(a.AllowedPattern, names) {
+		return nil, errClientNotAllow
+	}
+
+	return map[string]string{
+		"CertCommonName": cert.Subject.CommonName,
+		"CertSubject":    cert.Subject.String(),
+		"CertSANs":       strings.Join(names[2:], ","),
+		"CertSerial":     cert.SerialNumber.String(),
+	}, nil
+}
+
+// certNames returns the common name, subject and SANs of a certificate
+func certNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName, cert.Subject.String()}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+func matchAny(pattern *regexp.Regexp, names []string) bool {
+	for _, name := range names {
+		if name != "" && pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
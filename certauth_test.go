@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a server certificate
+// for 127.0.0.1, or of a client certificate with the common name
+func (ca *testCA) issue(t *testing.T, cn string, server bool) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn + ".clients.test"},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientTLS returns the client TLS config trusting the CA, with the
+// certificate of cn when set
+func (ca *testCA) clientTLS(t *testing.T, cn string) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conf := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+	if cn != "" {
+		cert, err := tls.X509KeyPair(ca.issue(t, cn, false))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf
+}
+
+// writeTLSFiles writes the server certificate and key issued by the CA
+// and the CA bundle, filling the TLS params
+func writeTLSFiles(t *testing.T, ca *testCA, cfg *params) {
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "server", true)
+	cfg.TLSCertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLSKeyFile = filepath.Join(dir, "key.pem")
+	cfg.TLSClientCAFile = filepath.Join(dir, "ca.pem")
+	for path, data := range map[string][]byte{cfg.TLSCertFile: certPEM, cfg.TLSKeyFile: keyPEM, cfg.TLSClientCAFile: ca.pem} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+// serveTLS serves SOCKS5 and the HTTP proxy over TLS, with the client
+// certificate authenticator built from cfg
+func serveTLS(t *testing.T, cfg params, creds socks5.CredentialStore, conf *socks5.Config) string {
+	tlsConf, err := newTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	clientCerts, err := newClientCertAuthenticator(cfg, creds)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.AuthMethods = []socks5.Authenticator{clientCerts}
+	conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	server, err := socks5.New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mux := &protocolMux{
+		socks:       server,
+		http:        &httpProxy{config: conf, credentials: creds, clientCerts: clientCerts, isIPAllowed: server.IsIPAllowed},
+		isIPAllowed: server.IsIPAllowed,
+		logger:      conf.Logger,
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go mux.Serve(l)
+	return l.Addr().String()
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	echo := echoServer(t)
+	ca := newTestCA(t)
+	other := newTestCA(t)
+
+	// The dial records the identity of the request
+	users := make(chan map[string]string, 1)
+	conf := func() *socks5.Config {
+		return &socks5.Config{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			req, _ := socks5.RequestFromContext(ctx)
+			users <- req.AuthContext.Payload
+			return net.Dial(network, addr)
+		}}
+	}
+
+	certOnly := params{TLSPort: "0", TLSMinVersion: "1.2", TLSClientAuth: "cert", TLSClientPattern: `^(alice|carol)$`}
+	writeTLSFiles(t, ca, &certOnly)
+	certOnlyAddr := serveTLS(t, certOnly, nil, conf())
+
+	withPassword := certOnly
+	withPassword.TLSClientAuth = "cert+password"
+	withPasswordAddr := serveTLS(t, withPassword, socks5.StaticCredentials{"foo": "bar"}, conf())
+
+	for _, tc := range []struct {
+		name   string
+		addr   string
+		user   string
+		client *tls.Config
+		want   string
+	}{
+		{"cert", certOnlyAddr, "", ca.clientTLS(t, "alice"), "alice"},
+		{"no cert", certOnlyAddr, "", ca.clientTLS(t, ""), ""},
+		{"pattern", certOnlyAddr, "", ca.clientTLS(t, "bob"), ""},
+		{"untrusted CA", certOnlyAddr, "", &tls.Config{RootCAs: ca.clientTLS(t, "").RootCAs, ServerName: "127.0.0.1", Certificates: other.clientTLS(t, "alice").Certificates}, ""},
+		{"cert+password", withPasswordAddr, "foo:bar", ca.clientTLS(t, "carol"), "foo"},
+		{"cert+wrong password", withPasswordAddr, "foo:baz", ca.clientTLS(t, "carol"), ""},
+		{"password without cert", withPasswordAddr, "foo:bar", ca.clientTLS(t, ""), ""},
+	} {
+		for _, scheme := range []string{"socks5h", "http"} {
+			rawURL := scheme + "://" + tc.addr
+			if tc.user != "" {
+				rawURL = scheme + "://" + tc.user + "@" + tc.addr
+			}
+			up, err := newUpstream(rawURL, time.Second)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			up.tls = tc.client
+
+			conn, err := up.Dial(context.Background(), "tcp", echo.Addr().String())
+			if err == nil {
+				conn.Write([]byte("ping"))
+				buf := make([]byte, 4)
+				_, err = io.ReadFull(conn, buf)
+				conn.Close()
+			}
+			if tc.want == "" {
+				if err == nil {
+					t.Errorf("%s over %s: expected error", tc.name, scheme)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s over %s: err: %v", tc.name, scheme, err)
+			}
+			payload := <-users
+			if payload["Username"] != tc.want || payload["CertCommonName"] != certCN(tc.client) {
+				t.Errorf("%s over %s: bad payload %v", tc.name, scheme, payload)
+			}
+			if payload["CertSANs"] != certCN(tc.client)+".clients.test" {
+				t.Errorf("%s over %s: bad SANs %q", tc.name, scheme, payload["CertSANs"])
+			}
+		}
+	}
+}
+
+// certCN returns the common name of the client certificate
+func certCN(conf *tls.Config) string {
+	cert, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+
+	"github.com/serjs/socks5-server/go-socks5"
+)
+
+// credentialChain is a CredentialStore accepting users
+// valid in any of its stores
+type credentialChain []socks5.CredentialStore
+
+func (c credentialChain) Valid(user, password string) bool {
+	for _, store := range c {
+		if store.Valid(user, password) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c credentialChain) Verify(user, password string, remote net.Addr) (map[string]string, bool) {
+	attributes, ok, _ := c.Check(user, password, remote)
+	return attributes, ok
+}
+
+// Check returns the error of a failed store when no store accepts the
+// user, as the failed store might have
+func (c credentialChain) Check(user, password string, remote net.Addr) (map[string]string, bool, error) {
+	var failure error
+	for _, store := range c {
+		attributes, ok, err := socks5.CheckCredentials(store, user, password, remote)
+		if ok {
+			return attributes, true, nil
+		}
+		if err != nil && failure == nil {
+			failure = err
+		}
+	}
+	return nil, false, failure
+}
+
+// newCredentials builds the CredentialStore from the app params,
+// it is nil when no credentials are configured
+func newCredentials(cfg params) (socks5.CredentialStore, error) {
+	var stores credentialChain
+	if cfg.User != "" && cfg.Password != "" {
+		stores = append(stores, socks5.StaticCredentials{
+			cfg.User: cfg.Password,
+		})
+	}
+	if cfg.UsersFile != "" {
+		users, err := newHtpasswdCredentials(cfg.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, users)
+	}
+	if cfg.AuthHTTPURL != "" {
+		cache := newAuthCache(cfg.AuthCacheTTL, cfg.AuthNegativeCacheTTL)
+		stores = append(stores, newHTTPAuthCredentials(cfg.AuthHTTPURL, cfg.AuthHTTPTimeout, cache))
+	}
+	if cfg.LDAPURL != "" {
+		cache := newAuthCache(cfg.AuthCacheTTL, cfg.AuthNegativeCacheTTL)
+		directory, err := newLDAPCredentials(cfg, cache)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, directory)
+	}
+	if len(cfg.RADIUSServers) > 0 {
+		cache := newAuthCache(cfg.AuthCacheTTL, cfg.AuthNegativeCacheTTL)
+		radius, err := newRADIUSCredentials(cfg, cache)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, radius)
+	}
+
+	var store socks5.CredentialStore
+	switch len(stores) {
+	case 0:
+		return nil, nil
+	case 1:
+		store = stores[0]
+	default:
+		store = stores
+	}
+
+	// Session tokens in the username select the egress address
+	if cfg.EgressStrategy == egressStickySession {
+		store = sessionCredentials{store}
+	}
+	return store, nil
+}
+
+// sessionCredentials accepts usernames with a session token,
+// user-session-token, returning the token as the Session attribute
+type sessionCredentials struct {
+	socks5.CredentialStore
+}
+
+func (s sessionCredentials) Valid(user, password string) bool {
+	_, ok := s.Verify(user, password, nil)
+	return ok
+}
+
+func (s sessionCredentials) Verify(user, password string, remote net.Addr) (map[string]string, bool) {
+	attributes, ok, _ := s.Check(user, password, remote)
+	return attributes, ok
+}
+
+func (s sessionCredentials) Check(user, password string, remote net.Addr) (map[string]string, bool, error) {
+	attributes, ok, failure := socks5.CheckCredentials(s.CredentialStore, user, password, remote)
+	if ok {
+		return attributes, true, nil
+	}
+	base, token := socks5.SplitSession(user)
+	if token == "" {
+		return nil, false, failure
+	}
+	attributes, ok, err := socks5.CheckCredentials(s.CredentialStore, base, password, remote)
+	if !ok {
+		if failure == nil {
+			failure = err
+		}
+		return nil, false, failure
+	}
+	session := map[string]string{"Session": token}
+	for k, v := range attributes {
+		session[k] = v
+	}
+	return session, true, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// privateDestinations are the ranges blocked by the BLOCK_PRIVATE_DESTS
+// preset: private, loopback, link-local (with the cloud metadata services
+// on 169.254.169.254 and fd00:ec2::254), shared, multicast and reserved,
+// and the IPv6 ranges embedding IPv4 addresses: NAT64, 6to4 and Teredo
+var privateDestinations = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"2001::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// DestPolicyRuleSet is an implementation of the RuleSet which checks the
+// destination FQDN against a pattern, and the resolved destination IP
+// against CIDR allow and deny lists. Rules are evaluated after the
+// resolver, on the IP which is dialed, so DNS rebinding can not bypass them.
+type DestPolicyRuleSet struct {
+	// FqdnPattern is matched against the FQDN, or the IP when the
+	// client sent an IP literal. Nil allows all destinations.
+	FqdnPattern *regexp.Regexp
+	// Allowed lists the only allowed destination IPs, nil allows all
+	Allowed *prefixTrie
+	// Denied lists the destination IPs which are always blocked
+	Denied *prefixTrie
+}
+
+// newDestPolicy builds the destination policy from the app params,
+// it is nil when no destination rules are configured
+func newDestPolicy(cfg params) (*DestPolicyRuleSet, error) {
+	policy := &DestPolicyRuleSet{}
+	var err error
+	if cfg.AllowedDestFqdn != "" {
+		if policy.FqdnPattern, err = regexp.Compile(cfg.AllowedDestFqdn); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.AllowedDestIPs) > 0 {
+		if policy.Allowed, err = newPrefixTrie(cfg.AllowedDestIPs); err != nil {
+			return nil, err
+		}
+	}
+	denied := cfg.DeniedDestIPs
+	if cfg.BlockPrivateDests {
+		denied = append(append([]string(nil), privateDestinations...), denied...)
+	}
+	if len(denied) > 0 {
+		if policy.Denied, err = newPrefixTrie(denied); err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.FqdnPattern == nil && policy.Allowed == nil && policy.Denied == nil {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+func (p *DestPolicyRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if noDestination(req) {
+		return ctx, true
+	}
+	dest := req.DestAddr
+
+	if p.FqdnPattern != nil {
+		name := dest.FQDN
+		if name == "" {
+			name = dest.IP.String()
+		}
+		if !p.FqdnPattern.MatchString(name) {
+			return socks5.WithRuleReason(ctx, fmt.Sprintf("%s does not match the allowed destination pattern", name)), false
+		}
+	}
+	if reason := p.denyIP(dest.IP); reason != "" {
+		return socks5.WithRuleReason(ctx, reason), false
+	}
+	return ctx, true
+}
+
+// UsesDestIP reports whether destination IPs are allowed or denied
+func (p *DestPolicyRuleSet) UsesDestIP() bool {
+	return p.Allowed != nil || p.Denied != nil
+}
+
+// denyIP checks the IP against the allow and deny lists and returns why
+// it is denied. Destinations without an IP are only allowed without IP rules.
+func (p *DestPolicyRuleSet) denyIP(ip net.IP) string {
+	if p.Allowed == nil && p.Denied == nil {
+		return ""
+	}
+	if ip == nil {
+		return "destination IP is unknown"
+	}
+	if p.Denied != nil && p.Denied.ContainsIP(ip) {
+		return fmt.Sprintf("destination IP %s is denied", ip)
+	}
+	if p.Allowed != nil && !p.Allowed.ContainsIP(ip) {
+		return fmt.Sprintf("destination IP %s is not allowed", ip)
+	}
+	return ""
+}
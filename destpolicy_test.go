@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+func TestDestPolicy(t *testing.T) {
+	policy, err := newDestPolicy(params{
+		AllowedDestFqdn:   `^(example\.com|93\.184\.216\.34)$`,
+		BlockPrivateDests: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		command uint8
+		fqdn    string
+		ip      string
+		allow   bool
+	}{
+		{socks5.ConnectCommand, "example.com", "93.184.216.34", true},
+		{socks5.ConnectCommand, "", "93.184.216.34", true},
+		// Rebound to a private or metadata address
+		{socks5.ConnectCommand, "example.com", "127.0.0.1", false},
+		{socks5.ConnectCommand, "example.com", "169.254.169.254", false},
+		{socks5.ConnectCommand, "example.com", "::ffff:10.0.0.1", false},
+		{socks5.ConnectCommand, "example.com", "fd00:ec2::254", false},
+		{socks5.ConnectCommand, "example.com", "64:ff9b::a9fe:a9fe", false},
+		{socks5.ConnectCommand, "example.com", "2002:a00:1::1", false},
+		// IP literals are matched against the pattern
+		{socks5.ConnectCommand, "", "1.1.1.1", false},
+		{socks5.ConnectCommand, "other.com", "93.184.216.34", false},
+		{socks5.ConnectCommand, "", "0.0.0.0", false},
+		{socks5.BindCommand, "", "0.0.0.0", true},
+	} {
+		req := &socks5.Request{
+			Command:  tc.command,
+			DestAddr: &socks5.AddrSpec{FQDN: tc.fqdn, IP: net.ParseIP(tc.ip), Port: 80},
+		}
+		if _, allow := policy.Allow(context.Background(), req); allow != tc.allow {
+			t.Errorf("%v: got %v, want %v", req.DestAddr, allow, tc.allow)
+		}
+	}
+
+	// An associate request states the client address, which may be
+	// private, only its datagrams are checked against the destinations
+	rules, err := newRules(params{BlockPrivateDests: true, DeniedDestIPs: []string{"192.0.2.0/24"}}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, ip := range []string{"10.0.0.5", "192.0.2.7"} {
+		req := &socks5.Request{
+			Command:  socks5.AssociateCommand,
+			DestAddr: &socks5.AddrSpec{IP: net.ParseIP(ip), Port: 5000},
+		}
+		if _, allow := rules.Allow(context.Background(), req); !allow {
+			t.Errorf("associate from %s: denied", ip)
+		}
+		req.Datagram = true
+		if _, allow := rules.Allow(context.Background(), req); allow {
+			t.Errorf("datagram to %s: allowed", ip)
+		}
+	}
+
+	if policy, _ := newDestPolicy(params{}); policy != nil {
+		t.Fatalf("expected no policy")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// errNoSuchHost is returned when a server answers that the name does not exist
+var errNoSuchHost = errors.New("no such host")
+
+// dnsServer is a nameserver reached over UDP (falling back to TCP for
+// truncated answers), TCP, DNS-over-TLS or DNS-over-HTTPS
+type dnsServer struct {
+	proto string
+	addr  string
+	url   string
+	tls   *tls.Config
+	http  *http.Client
+}
+
+// dnsResolver resolves names with the configured nameservers, trying
+// them in turn from the last one which answered
+type dnsResolver struct {
+	servers []*dnsServer
+	timeout time.Duration
+
+	preferred atomic.Int32
+}
+
+// newDNSResolver parses the DNS_SERVERS entries: 1.1.1.1, udp://1.1.1.1:53,
+// tcp://1.1.1.1:53, tls://one.one.one.one:853 or https://host/dns-query
+func newDNSResolver(cfg params) (*dnsResolver, error) {
+	r := &dnsResolver{timeout: cfg.DNSTimeout}
+	for _, entry := range cfg.DNSServers {
+		if entry == "" {
+			continue
+		}
+		server, err := parseDNSServer(entry)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, server)
+	}
+	if len(r.servers) == 0 {
+		return nil, fmt.Errorf("DNS_SERVERS contains no servers")
+	}
+	return r, nil
+}
+
+func parseDNSServer(entry string) (*dnsServer, error) {
+	if !strings.Contains(entry, "://") {
+		entry = "udp://" + entry
+	}
+	u, err := url.Parse(entry)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("DNS server %q has no host", entry)
+	}
+
+	server := &dnsServer{proto: u.Scheme}
+	switch u.Scheme {
+	case "udp", "tcp":
+		server.addr = net.JoinHostPort(u.Hostname(), defaultString(u.Port(), "53"))
+	case "tls":
+		server.addr = net.JoinHostPort(u.Hostname(), defaultString(u.Port(), "853"))
+		server.tls = &tls.Config{ServerName: u.Hostname()}
+	case "https":
+		server.url = u.String()
+		server.tls = &tls.Config{ServerName: u.Hostname()}
+		server.http = &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   server.tls,
+			ForceAttemptHTTP2: true,
+		}}
+	default:
+		return nil, fmt.Errorf("unsupported DNS server scheme %q", u.Scheme)
+	}
+	return server, nil
+}
+
+// String returns the address or URL of the server
+func (s *dnsServer) String() string {
+	if s.url != "" {
+		return s.url
+	}
+	return s.proto + "://" + s.addr
+}
+
+// Resolve returns the first address of the name
+func (r *dnsResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAll returns the A and AAAA records of the name, looked up
+// in parallel
+func (r *dnsResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, []net.IP{ip}, nil
+	}
+
+	type lookup struct {
+		ips []net.IP
+		err error
+	}
+	lookups := make(chan lookup, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+		go func() {
+			ips, err := r.lookup(ctx, name, qtype)
+			lookups <- lookup{ips, err}
+		}()
+	}
+
+	var ips []net.IP
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		result := <-lookups
+		ips = append(ips, result.ips...)
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+		}
+	}
+	if len(ips) > 0 {
+		return ctx, ips, nil
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no addresses for %s", name)
+	}
+	return ctx, nil, fmt.Errorf("lookup %s: %w", name, firstErr)
+}
+
+// lookup queries the servers in turn until one answers, a name
+// which does not exist is not asked to the next servers
+func (r *dnsResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, error) {
+	query, id, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	start := int(r.preferred.Load())
+	var lastErr error
+	for i := range r.servers {
+		index := (start + i) % len(r.servers)
+		server := r.servers[index]
+
+		queryCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		ips, err := server.exchange(queryCtx, query, id, qtype)
+		cancel()
+		if err == nil || errors.Is(err, errNoSuchHost) {
+			r.preferred.Store(int32(index))
+			return ips, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = fmt.Errorf("%s: %v", server, err)
+	}
+	return nil, lastErr
+}
+
+// newDNSQuery builds a recursive query with a random ID
+func newDNSQuery(name string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var id [2]byte
+	rand.Read(id[:])
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := msg.Pack()
+	return query, msg.Header.ID, err
+}
+
+// exchange sends the query with the transport of the server
+func (s *dnsServer) exchange(ctx context.Context, query []byte, id uint16, qtype dnsmessage.Type) ([]net.IP, error) {
+	var answer []byte
+	var err error
+	switch s.proto {
+	case "udp":
+		answer, err = s.exchangeUDP(ctx, query, id)
+	case "https":
+		answer, err = s.exchangeHTTPS(ctx, query)
+	default:
+		answer, err = s.exchangeStream(ctx, s.proto, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSAnswer(answer, id, qtype)
+}
+
+// exchangeUDP sends the query over UDP, and again over TCP when the
+// answer is truncated
+func (s *dnsServer) exchangeUDP(ctx context.Context, query []byte, id uint16) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var header dnsmessage.Header
+		var parser dnsmessage.Parser
+		if header, err = parser.Start(buf[:n]); err != nil || header.ID != id || !header.Response {
+			// Not the answer to this query
+			continue
+		}
+		if header.Truncated {
+			return s.exchangeStream(ctx, "tcp", query)
+		}
+		return buf[:n], nil
+	}
+}
+
+// exchangeStream sends the length-prefixed query over TCP or TLS
+func (s *dnsServer) exchangeStream(ctx context.Context, proto string, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if proto == "tls" {
+		conn, err = (&tls.Dialer{Config: s.tls}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// exchangeHTTPS posts the query to the DoH server, RFC 8484
+func (s *dnsServer) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// parseDNSAnswer returns the addresses of the answer, the CNAME
+// records followed by the recursive server are skipped
+func parseDNSAnswer(answer []byte, id uint16, qtype dnsmessage.Type) ([]net.IP, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(answer)
+	if err != nil {
+		return nil, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, fmt.Errorf("answer does not match the query")
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, errNoSuchHost
+	default:
+		return nil, fmt.Errorf("server answered %v", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for {
+		h, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case h.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case h.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
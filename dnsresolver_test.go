@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsAnswer answers the query for example.test, other names do not exist
+func dnsAnswer(t *testing.T, query []byte, truncate bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Errorf("err: %v", err)
+		return nil
+	}
+	msg.Header.Response = true
+	q := msg.Questions[0]
+	if q.Name.String() != "example.test." {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	} else if truncate {
+		msg.Header.Truncated = true
+	} else {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+		switch q.Type {
+		case dnsmessage.TypeA:
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+		case dnsmessage.TypeAAAA:
+			aaaa := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+		}
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		t.Errorf("err: %v", err)
+	}
+	return answer
+}
+
+// serveDNSStream answers length-prefixed queries on the listener
+func serveDNSStream(t *testing.T, l net.Listener) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				answer := dnsAnswer(t, query, false)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+			}()
+		}
+	}()
+}
+
+func TestDNSResolver(t *testing.T) {
+	// UDP answers are truncated, the query is sent again over TCP
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serveDNSStream(t, tcp)
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(dnsAnswer(t, buf[:n], true), addr)
+		}
+	}()
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(t, query, false))
+	}))
+	t.Cleanup(doh.Close)
+	dot, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serveDNSStream(t, dot)
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+
+	// A server which does not answer
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { silent.Close() })
+
+	for _, server := range []string{
+		tcp.Addr().String(),
+		"tcp://" + tcp.Addr().String(),
+		"tls://" + dot.Addr().String(),
+		doh.URL + "/dns-query",
+	} {
+		r, err := newDNSResolver(params{
+			DNSServers: []string{"udp://" + silent.LocalAddr().String(), server},
+			DNSTimeout: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for _, s := range r.servers {
+			if s.tls != nil {
+				s.tls.RootCAs = roots
+				s.tls.ServerName = "example.com"
+			}
+		}
+
+		_, ips, err := r.ResolveAll(context.Background(), "example.test")
+		if err != nil {
+			t.Fatalf("%s: err: %v", server, err)
+		}
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != "[192.0.2.1 2001:db8::1]" {
+			t.Errorf("%s: bad addresses %v", server, got)
+		}
+		if r.preferred.Load() != 1 {
+			t.Errorf("%s: answering server not preferred", server)
+		}
+
+		if _, _, err := r.Resolve(context.Background(), "missing.test"); !errors.Is(err, errNoSuchHost) {
+			t.Errorf("%s: got %v, want %v", server, err, errNoSuchHost)
+		}
+	}
+
+	if _, err := newDNSResolver(params{DNSServers: []string{"quic://127.0.0.1"}}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// Egress address selection strategies
+const (
+	egressRandom        = "random"
+	egressRoundRobin    = "round-robin"
+	egressStickyUser    = "sticky-user"
+	egressStickySession = "sticky-session"
+)
+
+// egressPool selects the source address of outbound connections from
+// addresses and prefixes, picking addresses inside a prefix at random
+// or, for sticky strategies, from the hash of the user or session
+type egressPool struct {
+	v4, v6   []netip.Prefix
+	strategy string
+
+	next atomic.Uint64
+}
+
+// newEgressPool parses the EGRESS_ADDRESSES addresses and prefixes
+func newEgressPool(cfg params) (*egressPool, error) {
+	switch cfg.EgressStrategy {
+	case egressRandom, egressRoundRobin, egressStickyUser, egressStickySession:
+	default:
+		return nil, fmt.Errorf("unknown EGRESS_STRATEGY %q", cfg.EgressStrategy)
+	}
+
+	p := &egressPool{strategy: cfg.EgressStrategy}
+	for _, entry := range cfg.EgressAddresses {
+		if entry == "" {
+			continue
+		}
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Addr().Is4() {
+			p.v4 = append(p.v4, prefix)
+		} else {
+			p.v6 = append(p.v6, prefix)
+		}
+	}
+	if len(p.v4) == 0 && len(p.v6) == 0 {
+		return nil, fmt.Errorf("EGRESS_ADDRESSES contains no addresses")
+	}
+	return p, nil
+}
+
+// Select returns the source IP for a connection to dest, nil when
+// the pool has no address of the destination family
+func (p *egressPool) Select(ctx context.Context, dest net.IP) net.IP {
+	prefixes := p.v6
+	if dest.To4() != nil {
+		prefixes = p.v4
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	var seed [24]byte
+	key := p.stickyKey(ctx)
+	if key != "" {
+		first := sha256.Sum256([]byte(key))
+		second := sha256.Sum256(first[:])
+		copy(seed[:], append(first[:], second[:]...))
+	} else {
+		rand.Read(seed[:])
+	}
+
+	var index uint64
+	switch {
+	case key != "":
+		index = binary.BigEndian.Uint64(seed[:8])
+	case p.strategy == egressRoundRobin:
+		index = p.next.Add(1) - 1
+	default:
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(prefixes))))
+		index = n.Uint64()
+	}
+	prefix := prefixes[index%uint64(len(prefixes))]
+	return net.IP(prefixAddr(prefix, seed[8:]).AsSlice())
+}
+
+// stickyKey returns what keeps connections on the same address, the
+// username or the session token, empty for the other strategies and
+// sessions without a token
+func (p *egressPool) stickyKey(ctx context.Context) string {
+	switch p.strategy {
+	case egressStickyUser:
+		return hashKey(ctx)
+	case egressStickySession:
+		if req, ok := socks5.RequestFromContext(ctx); ok && req.AuthContext != nil {
+			if token := req.AuthContext.Payload["Session"]; token != "" {
+				return req.AuthContext.Payload["Username"] + "\x00" + token
+			}
+		}
+	}
+	return ""
+}
+
+// prefixAddr returns the address of the prefix with its host bits
+// taken from bits, avoiding the network and broadcast addresses of
+// IPv4 prefixes
+func prefixAddr(prefix netip.Prefix, bits []byte) netip.Addr {
+	addr := prefix.Addr().AsSlice()
+	hostBits := len(addr)*8 - prefix.Bits()
+	if hostBits == 0 {
+		return prefix.Addr()
+	}
+	for i := range addr {
+		// Bits of this byte belonging to the host part
+		start := max(prefix.Bits()-i*8, 0)
+		if start >= 8 {
+			continue
+		}
+		mask := byte(0xff >> start)
+		addr[i] = addr[i]&^mask | bits[i%len(bits)]&mask
+	}
+
+	if len(addr) == net.IPv4len && hostBits >= 2 {
+		v := binary.BigEndian.Uint32(addr)
+		hostMask := uint32(1)<<hostBits - 1
+		switch v & hostMask {
+		case 0:
+			v++
+		case hostMask:
+			v--
+		}
+		binary.BigEndian.PutUint32(addr, v)
+	}
+	result, _ := netip.AddrFromSlice(addr)
+	return result
+}
+
+// ipFamilies maps the IP_FAMILY values to the socks5 preferences
+var ipFamilies = map[string]uint8{
+	"prefer-ipv4": socks5.PreferIPv4,
+	"prefer-ipv6": socks5.PreferIPv6,
+	"ipv4-only":   socks5.IPv4Only,
+	"ipv6-only":   socks5.IPv6Only,
+}
+
+// parseIPFamily parses the IP_FAMILY param
+func parseIPFamily(s string) (uint8, error) {
+	family, ok := ipFamilies[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown IP_FAMILY %q", s)
+	}
+	return family, nil
+}
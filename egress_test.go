@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+func TestEgressPool(t *testing.T) {
+	v4 := net.IPv4(192, 0, 2, 1)
+	v6 := net.ParseIP("2001:db8::1")
+
+	pool, err := newEgressPool(params{
+		EgressAddresses: []string{"198.51.100.1", "198.51.100.2", "2001:db8:1::/64", ""},
+		EgressStrategy:  egressRoundRobin,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[pool.Select(context.Background(), v4).String()] = true
+	}
+	if len(seen) != 2 || !seen["198.51.100.1"] || !seen["198.51.100.2"] {
+		t.Fatalf("bad round robin: %v", seen)
+	}
+	prefix := netip.MustParsePrefix("2001:db8:1::/64")
+	first := pool.Select(context.Background(), v6)
+	addr, _ := netip.AddrFromSlice(first)
+	if !prefix.Contains(addr) || first.Equal(pool.Select(context.Background(), v6)) {
+		t.Fatalf("bad random address %v", first)
+	}
+
+	// Users keep their address, sessions without a token do not
+	ctx := func(user, session string) context.Context {
+		return socks5.WithRequest(context.Background(), &socks5.Request{
+			AuthContext: &socks5.AuthContext{Payload: map[string]string{"Username": user, "Session": session}},
+		})
+	}
+	for _, strategy := range []string{egressStickyUser, egressStickySession} {
+		pool.strategy = strategy
+		want := pool.Select(ctx("alice", "1"), v6)
+		if got := pool.Select(ctx("alice", "1"), v6); !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", strategy, got, want)
+		}
+	}
+	if pool.Select(ctx("alice", "1"), v6).Equal(pool.Select(ctx("alice", "2"), v6)) {
+		t.Errorf("sessions share an address")
+	}
+	if pool.Select(ctx("alice", ""), v6).Equal(pool.Select(ctx("alice", ""), v6)) {
+		t.Errorf("sessions without token share an address")
+	}
+
+	// Only addresses of the destination family are used
+	pool, err = newEgressPool(params{EgressAddresses: []string{"203.0.113.0/30"}, EgressStrategy: egressRandom})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ip := pool.Select(context.Background(), v6); ip != nil {
+		t.Errorf("got %v for an IPv6 destination", ip)
+	}
+	for i := 0; i < 32; i++ {
+		if ip := pool.Select(context.Background(), v4).String(); ip != "203.0.113.1" && ip != "203.0.113.2" {
+			t.Fatalf("bad address %v", ip)
+		}
+	}
+
+	if _, err := newEgressPool(params{EgressAddresses: []string{"198.51.100.1"}, EgressStrategy: "sticky"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSessionCredentials(t *testing.T) {
+	creds := sessionCredentials{socks5.StaticCredentials{"alice": "secret"}}
+	attributes, ok := creds.Verify("alice-session-abc", "secret", nil)
+	if !ok || attributes["Session"] != "abc" {
+		t.Fatalf("bad session: %v %v", attributes, ok)
+	}
+	if user := socks5.SessionUsername("alice-session-abc", attributes); user != "alice" {
+		t.Fatalf("bad username %q", user)
+	}
+	if creds.Valid("alice-session-abc", "wrong") || creds.Valid("bob-session-abc", "secret") {
+		t.Fatalf("invalid credentials accepted")
+	}
+}
@@ -3,6 +3,7 @@ package socks5
 import (
 	"fmt"
 	"io"
+	"net"
 )
 
 const (
@@ -15,8 +16,9 @@ const (
 )
 
 var (
-	UserAuthFailed  = fmt.Errorf("User authentication failed")
-	NoSupportedAuth = fmt.Errorf("No supported authentication mechanism")
+	UserAuthFailed      = fmt.Errorf("User authentication failed")
+	UserAuthUnavailable = fmt.Errorf("User authentication unavailable")
+	NoSupportedAuth     = fmt.Errorf("No supported authentication mechanism")
 )
 
 // A Request encapsulates authentication state provided
@@ -94,7 +96,19 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
+	var remote net.Addr
+	if conn, ok := writer.(interface{ RemoteAddr() net.Addr }); ok {
+		remote = conn.RemoteAddr()
+	}
+	attributes, valid, err := CheckCredentials(a.Credentials, string(user), string(pass), remote)
+	if err != nil {
+		// The client is refused, but the failure is not its fault
+		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", UserAuthUnavailable, err)
+	}
+	if valid {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return nil, err
 		}
@@ -106,7 +120,20 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	return UserPassContext(string(user), attributes), nil
+}
+
+// UserPassContext builds the AuthContext of a user authenticated by
+// password, attributes from the credential store can not replace the Username
+// but the Session attribute strips the session token from it
+func UserPassContext(user string, attributes map[string]string) *AuthContext {
+	payload := map[string]string{"Username": SessionUsername(user, attributes)}
+	for k, v := range attributes {
+		if _, ok := payload[k]; !ok {
+			payload[k] = v
+		}
+	}
+	return &AuthContext{UserPassAuth, payload}
 }
 
 // authenticate is used to handle connection authentication
@@ -126,12 +153,12 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 	}
 
 	// No usable method found
-	return nil, noAcceptableAuth(conn)
+	return nil, NoAcceptableAuth(conn)
 }
 
-// noAcceptableAuth is used to handle when we have no eligible
+// NoAcceptableAuth is used to handle when we have no eligible
 // authentication mechanism
-func noAcceptableAuth(conn io.Writer) error {
+func NoAcceptableAuth(conn io.Writer) error {
 	conn.Write([]byte{socks5Version, noAcceptable})
 	return NoSupportedAuth
 }
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+)
+
+// CredentialStore is used to support user/pass authentication
+type CredentialStore interface {
+	Valid(user, password string) bool
+}
+
+// StaticCredentials enables using a map directly as a credential store
+type StaticCredentials map[string]string
+
+func (s StaticCredentials) Valid(user, password string) bool {
+	pass, ok := s[user]
+	if !ok {
+		return false
+	}
+	return password == pass
+}
+
+// CredentialVerifier is a CredentialStore which also gets the client
+// address, and can return attributes for the AuthContext payload
+type CredentialVerifier interface {
+	CredentialStore
+	Verify(user, password string, remote net.Addr) (map[string]string, bool)
+}
+
+// VerifyCredentials checks the credentials against the store, using
+// Verify for CredentialVerifier implementations
+func VerifyCredentials(creds CredentialStore, user, password string, remote net.Addr) (map[string]string, bool) {
+	if verifier, ok := creds.(CredentialVerifier); ok {
+		return verifier.Verify(user, password, remote)
+	}
+	return nil, creds.Valid(user, password)
+}
+
+// CredentialChecker is a CredentialVerifier backed by a service which can
+// fail. Check returns an error when the service could not decide, which
+// is not counted as a failed login.
+type CredentialChecker interface {
+	CredentialVerifier
+	Check(user, password string, remote net.Addr) (map[string]string, bool, error)
+}
+
+// CheckCredentials checks the credentials against the store like
+// VerifyCredentials, returning the error of CredentialChecker implementations
+func CheckCredentials(creds CredentialStore, user, password string, remote net.Addr) (map[string]string, bool, error) {
+	if checker, ok := creds.(CredentialChecker); ok {
+		return checker.Check(user, password, remote)
+	}
+	attributes, ok := VerifyCredentials(creds, user, password, remote)
+	return attributes, ok, nil
+}
+
+// SessionSeparator separates a session token appended to the
+// username, user-session-token
+const SessionSeparator = "-session-"
+
+// SplitSession splits the username and the session token
+func SplitSession(user string) (string, string) {
+	i := strings.LastIndex(user, SessionSeparator)
+	if i < 0 {
+		return user, ""
+	}
+	return user[:i], user[i+len(SessionSeparator):]
+}
+
+// SessionUsername returns the username without the session token when
+// the credential store accepted it and returned it as the Session attribute
+func SessionUsername(user string, attributes map[string]string) string {
+	if token := attributes["Session"]; token != "" {
+		return strings.TrimSuffix(user, SessionSeparator+token)
+	}
+	return user
+}
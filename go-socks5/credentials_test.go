@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestStaticCredentials(t *testing.T) {
+	creds := StaticCredentials{
+		"foo": "bar",
+		"baz": "",
+	}
+
+	if !creds.Valid("foo", "bar") {
+		t.Fatalf("expect valid")
+	}
+
+	if !creds.Valid("baz", "") {
+		t.Fatalf("expect valid")
+	}
+
+	if creds.Valid("foo", "") {
+		t.Fatalf("expect invalid")
+	}
+}
+
+type verifierCredentials struct {
+	StaticCredentials
+	remote net.Addr
+}
+
+func (v *verifierCredentials) Verify(user, password string, remote net.Addr) (map[string]string, bool) {
+	v.remote = remote
+	return map[string]string{"Group": "ops", "Username": "spoofed"}, v.Valid(user, password)
+}
+
+func TestVerifyCredentials(t *testing.T) {
+	creds := &verifierCredentials{StaticCredentials: StaticCredentials{"foo": "bar"}}
+	cator := UserPassAuthenticator{Credentials: creds}
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	resp := &MockConn{}
+
+	ctx, err := cator.Authenticate(req, resp)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Payload["Username"] != "foo" || ctx.Payload["Group"] != "ops" {
+		t.Fatalf("bad: %v", ctx.Payload)
+	}
+	if creds.remote == nil || creds.remote.String() != "127.0.0.1:65432" {
+		t.Fatalf("bad: %v", creds.remote)
+	}
+
+	if _, ok := VerifyCredentials(StaticCredentials{"foo": "bar"}, "foo", "baz", nil); ok {
+		t.Fatalf("expect invalid")
+	}
+}
+
+// unavailableCredentials is a CredentialChecker whose service is down
+type unavailableCredentials struct {
+	StaticCredentials
+}
+
+func (u unavailableCredentials) Verify(user, password string, remote net.Addr) (map[string]string, bool) {
+	return nil, false
+}
+
+func (u unavailableCredentials) Check(user, password string, remote net.Addr) (map[string]string, bool, error) {
+	return nil, false, errors.New("service down")
+}
+
+func TestCheckCredentials(t *testing.T) {
+	cator := UserPassAuthenticator{Credentials: unavailableCredentials{}}
+	req := bytes.NewBuffer([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	resp := &MockConn{}
+
+	// Failures of the service are not failed logins
+	_, err := cator.Authenticate(req, resp)
+	if !errors.Is(err, UserAuthUnavailable) || err == UserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.buf.Bytes(); !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	if _, ok, err := CheckCredentials(StaticCredentials{"foo": "bar"}, "foo", "baz", nil); ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,253 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// IP family preferences for Config.IPFamily, preferring IPv4 by default
+// like the system resolver, as UDP datagrams have no fallback
+const (
+	PreferIPv4 = uint8(iota)
+	PreferIPv6
+	IPv4Only
+	IPv6Only
+)
+
+// defaultHappyEyeballsDelay is the Connection Attempt Delay of RFC 8305
+const defaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// MultiNameResolver is a NameResolver which can return every
+// address of a name, to dial them in turn
+type MultiNameResolver interface {
+	NameResolver
+	ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error)
+}
+
+// ResolveAddr resolves the FQDN of dest, setting IPs to the resolved
+// addresses of the allowed families ordered by preference and IP to the
+// first one. IP literals of a disabled family return ErrNetworkUnreachable.
+func (c *Config) ResolveAddr(ctx context.Context, dest *AddrSpec) (context.Context, error) {
+	if dest.FQDN == "" {
+		if dest.IP != nil && !c.familyAllowed(dest.IP) {
+			return ctx, fmt.Errorf("%w: %s addresses are disabled", ErrNetworkUnreachable, family(dest.IP))
+		}
+		return ctx, nil
+	}
+
+	var ips []net.IP
+	if multi, ok := c.Resolver.(MultiNameResolver); ok {
+		ctx_, all, err := multi.ResolveAll(ctx, dest.FQDN)
+		if err != nil {
+			return ctx, err
+		}
+		ctx, ips = ctx_, all
+	} else {
+		ctx_, ip, err := c.Resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return ctx, err
+		}
+		ctx, ips = ctx_, []net.IP{ip}
+	}
+
+	ips = c.sortAddrs(ips)
+	if len(ips) == 0 {
+		return ctx, fmt.Errorf("No address of an enabled family for %s", dest.FQDN)
+	}
+	dest.IP = ips[0]
+	dest.IPs = ips
+	return ctx, nil
+}
+
+// ResolveRequest resolves the destination of the request, unless it
+// is a connect sent by name to a remote resolving Dial and the rules
+// do not check the destination IP
+func (c *Config) ResolveRequest(ctx context.Context, req *Request) (context.Context, error) {
+	if c.RemoteResolve && req.Command == ConnectCommand && req.DestAddr.FQDN != "" && !UsesDestIP(c.Rules) {
+		return ctx, nil
+	}
+	return c.ResolveAddr(ctx, req.DestAddr)
+}
+
+// LookupIP resolves host for a Dial which needs an IP, reusing the
+// address resolved for the request or else resolving it like the
+// server whose config is in the context
+func LookupIP(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	if req, ok := RequestFromContext(ctx); ok && req.DestAddr.FQDN == host && req.DestAddr.IP != nil {
+		return req.DestAddr.IP, nil
+	}
+	conf, ok := ctx.Value(configKey{}).(*Config)
+	if !ok || conf.Resolver == nil {
+		conf = &Config{Resolver: DNSResolver{}}
+	}
+	dest := &AddrSpec{FQDN: host}
+	if _, err := conf.ResolveAddr(ctx, dest); err != nil {
+		return nil, err
+	}
+	return dest.IP, nil
+}
+
+func (c *Config) familyAllowed(ip net.IP) bool {
+	switch c.IPFamily {
+	case IPv4Only:
+		return ip.To4() != nil
+	case IPv6Only:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+func family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// sortAddrs drops the addresses of disabled families and interleaves
+// the families, starting with the preferred one, RFC 8305 section 4
+func (c *Config) sortAddrs(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip == nil || !c.familyAllowed(ip) {
+			continue
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v4, v6
+	if c.IPFamily == PreferIPv6 {
+		first, second = v6, v4
+	}
+
+	sorted := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// AllowRequest checks the request against the rules once per resolved
+// destination IP, keeping only the allowed IPs in the destination.
+func (c *Config) AllowRequest(ctx context.Context, req *Request) (context.Context, bool) {
+	dest := req.DestAddr
+	if len(dest.IPs) <= 1 {
+		return c.Rules.Allow(ctx, req)
+	}
+
+	var allowed []net.IP
+	var allowedCtx, deniedCtx context.Context
+	for _, ip := range dest.IPs {
+		single := *req
+		single.DestAddr = &AddrSpec{FQDN: dest.FQDN, IP: ip, Port: dest.Port}
+		ctx_, ok := c.Rules.Allow(ctx, &single)
+		if !ok {
+			if deniedCtx == nil {
+				deniedCtx = ctx_
+			}
+			continue
+		}
+		if allowedCtx == nil {
+			allowedCtx = ctx_
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) == 0 {
+		return deniedCtx, false
+	}
+	dest.IP = allowed[0]
+	dest.IPs = allowed
+	return allowedCtx, true
+}
+
+// DialAddr connects to dest with dial, by name with RemoteResolve unless
+// the name was resolved locally for the rules, then the checked IPs are
+// dialed so that the Dial can not resolve it again. When dest has several
+// IPs, they are raced Happy Eyeballs style: a new attempt starts when the
+// previous one fails or after HappyEyeballsDelay, the first connection wins.
+func (c *Config) DialAddr(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, dest *AddrSpec) (net.Conn, error) {
+	if c.RemoteResolve && dest.FQDN != "" && dest.IP == nil {
+		return dial(ctx, network, net.JoinHostPort(dest.FQDN, strconv.Itoa(dest.Port)))
+	}
+	return c.dialAll(ctx, dial, network, dest)
+}
+
+// dialAll races the IPs of dest
+func (c *Config) dialAll(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, dest *AddrSpec) (net.Conn, error) {
+	if len(dest.IPs) <= 1 {
+		return dial(ctx, network, dest.Address())
+	}
+
+	delay := c.HappyEyeballsDelay
+	if delay <= 0 {
+		delay = defaultHappyEyeballsDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(dest.IPs))
+	next, pending := 0, 0
+	start := func() {
+		addr := AddrSpec{IP: dest.IPs[next], Port: dest.Port}
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr.Address())
+			results <- attempt{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close the connections of the attempts still running
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(dest.IPs) {
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(dest.IPs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type staticResolver []net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, r[0], nil
+}
+
+func (r staticResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	return ctx, r, nil
+}
+
+func TestResolveAddr(t *testing.T) {
+	resolver := staticResolver{
+		net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3"),
+	}
+	for family, want := range map[uint8]string{
+		PreferIPv6: "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::3]",
+		PreferIPv4: "[192.0.2.1 2001:db8::1 192.0.2.2 2001:db8::2 2001:db8::3]",
+		IPv4Only:   "[192.0.2.1 192.0.2.2]",
+		IPv6Only:   "[2001:db8::1 2001:db8::2 2001:db8::3]",
+	} {
+		conf := &Config{Resolver: resolver, IPFamily: family}
+		dest := &AddrSpec{FQDN: "example.com", Port: 80}
+		if _, err := conf.ResolveAddr(context.Background(), dest); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got := fmt.Sprint(dest.IPs); got != want || !dest.IP.Equal(dest.IPs[0]) {
+			t.Errorf("family %d: got %s, want %s", family, got, want)
+		}
+	}
+
+	// IPv4 is preferred by default, datagrams are sent to the first address
+	var conf Config
+	if conf.IPFamily != PreferIPv4 {
+		t.Fatalf("bad default family %d", conf.IPFamily)
+	}
+
+	conf = Config{Resolver: resolver, IPFamily: IPv4Only}
+	if _, err := conf.ResolveAddr(context.Background(), &AddrSpec{IP: net.ParseIP("2001:db8::1")}); !errors.Is(err, ErrNetworkUnreachable) {
+		t.Fatalf("got %v, want %v", err, ErrNetworkUnreachable)
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	conf := &Config{Rules: ruleFunc(func(ctx context.Context, req *Request) (context.Context, bool) {
+		return ctx, !req.DestAddr.IP.IsPrivate()
+	})}
+	req := &Request{DestAddr: &AddrSpec{
+		FQDN: "example.com",
+		IP:   net.ParseIP("10.0.0.1"),
+		IPs:  []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("192.0.2.1")},
+	}}
+	if _, ok := conf.AllowRequest(context.Background(), req); !ok {
+		t.Fatalf("request denied")
+	}
+	if fmt.Sprint(req.DestAddr.IPs) != "[192.0.2.1]" || !req.DestAddr.IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("denied address kept: %v %v", req.DestAddr.IP, req.DestAddr.IPs)
+	}
+
+	req.DestAddr.IPs = []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	if _, ok := conf.AllowRequest(context.Background(), req); ok {
+		t.Fatalf("request allowed")
+	}
+}
+
+func TestDialAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// The first address hangs, the second is refused and the third works
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch addr {
+		case net.JoinHostPort("192.0.2.1", fmt.Sprint(port)):
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case net.JoinHostPort("192.0.2.2", fmt.Sprint(port)):
+			return nil, ErrConnectionRefused
+		}
+		return net.Dial(network, net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	}
+	conf := &Config{HappyEyeballsDelay: 50 * time.Millisecond}
+	dest := &AddrSpec{
+		Port: port,
+		IPs:  []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("127.0.0.1")},
+	}
+	conn, err := conf.DialAddr(context.Background(), dial, "tcp", dest)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	dest.IPs = dest.IPs[1:2]
+	dest.IP = dest.IPs[0]
+	if _, err := conf.DialAddr(context.Background(), dial, "tcp", dest); !errors.Is(err, ErrConnectionRefused) {
+		t.Fatalf("got %v, want %v", err, ErrConnectionRefused)
+	}
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports used when the server has to
+// open sockets on its own, like for udp associate.
+// The zero value lets the OS pick any free port.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// ParsePortRange parses a single port ("8000") or a
+// range of ports ("8000-8100"). An empty string is the zero PortRange
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return PortRange{}, nil
+	}
+
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	from, err := parsePort(first)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("Invalid port range '%s': %v", s, err)
+	}
+	to, err := parsePort(last)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("Invalid port range '%s': %v", s, err)
+	}
+	if from > to {
+		return PortRange{}, fmt.Errorf("Invalid port range '%s': first port is greater than last", s)
+	}
+	return PortRange{First: from, Last: to}, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+	return port, nil
+}
+
+// Contains checks if the port is part of the range
+func (r PortRange) Contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(r.First)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// listen calls fn with every port of the range, starting from a random one,
+// until it succeeds. The zero PortRange calls fn once with port 0.
+func (r PortRange) listen(fn func(port int) error) error {
+	if r.First == 0 && r.Last == 0 {
+		return fn(0)
+	}
+
+	size := r.Last - r.First + 1
+	offset := rand.Intn(size)
+	var err error
+	for i := 0; i < size; i++ {
+		port := r.First + (offset+i)%size
+		if err = fn(port); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("No free port in range %v: %v", r, err)
+}
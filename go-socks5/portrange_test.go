@@ -0,0 +1,32 @@
+package socks5
+
+import (
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	r, err := ParsePortRange("8000-8100")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if r.First != 8000 || r.Last != 8100 {
+		t.Fatalf("bad: %v", r)
+	}
+	if !r.Contains(8050) || r.Contains(8101) {
+		t.Fatalf("bad: %v", r)
+	}
+
+	r, err = ParsePortRange("443")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if r.First != 443 || r.Last != 443 {
+		t.Fatalf("bad: %v", r)
+	}
+
+	for _, s := range []string{"0", "70000", "90-80", "http"} {
+		if _, err := ParsePortRange(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	ConnectCommand   = uint8(1)
+	BindCommand      = uint8(2)
+	AssociateCommand = uint8(3)
+	ipv4Address      = uint8(1)
+	fqdnAddress      = uint8(3)
+	ipv6Address      = uint8(4)
+)
+
+const (
+	successReply uint8 = iota
+	serverFailure
+	ruleFailure
+	networkUnreachable
+	hostUnreachable
+	connectionRefused
+	ttlExpired
+	commandNotSupported
+	addrTypeNotSupported
+)
+
+var (
+	unrecognizedAddrType = fmt.Errorf("Unrecognized address type")
+)
+
+// Errors a custom Dial can return, wrapped or not, to select the reply
+// sent to the client when the connect fails
+var (
+	ErrServerFailure      = errors.New("General SOCKS server failure")
+	ErrRuleFailure        = errors.New("Connection not allowed by ruleset")
+	ErrNetworkUnreachable = errors.New("Network unreachable")
+	ErrHostUnreachable    = errors.New("Host unreachable")
+	ErrConnectionRefused  = errors.New("Connection refused")
+	ErrTTLExpired         = errors.New("TTL expired")
+)
+
+// AddressRewriter is used to rewrite a destination transparently
+type AddressRewriter interface {
+	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
+}
+
+// AddrSpec is used to return the target AddrSpec
+// which may be specified as IPv4, IPv6, or a FQDN
+type AddrSpec struct {
+	FQDN string
+	IP   net.IP
+	Port int
+	// IPs are all the resolved addresses of the FQDN in dial order,
+	// IP is the first one
+	IPs []net.IP
+}
+
+func (a *AddrSpec) String() string {
+	if a.FQDN != "" {
+		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
+	}
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+// Address returns a string suitable to dial; prefer returning IP-based
+// address, fallback to FQDN
+func (a AddrSpec) Address() string {
+	if 0 != len(a.IP) {
+		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+	}
+	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
+}
+
+// A Request represents request received by a server
+type Request struct {
+	// Protocol version
+	Version uint8
+	// Requested command
+	Command uint8
+	// AuthContext provided during negotiation
+	AuthContext *AuthContext
+	// AddrSpec of the the network that sent the request
+	RemoteAddr *AddrSpec
+	// AddrSpec of the desired destination
+	DestAddr *AddrSpec
+	// Datagram is set when the rules check the destination of a UDP
+	// ASSOCIATE datagram, the associate request itself states the
+	// client address instead of a destination
+	Datagram bool
+	// AddrSpec of the actual destination (might be affected by rewrite)
+	realDestAddr *AddrSpec
+	bufConn      io.Reader
+}
+
+type conn interface {
+	Write([]byte) (int, error)
+	RemoteAddr() net.Addr
+}
+
+// NewRequest creates a new Request from the tcp connection
+func NewRequest(bufConn io.Reader) (*Request, error) {
+	// Read the version byte
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadAtLeast(bufConn, header, 3); err != nil {
+		return nil, fmt.Errorf("Failed to get command version: %v", err)
+	}
+
+	// Ensure we are compatible
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("Unsupported command version: %v", header[0])
+	}
+
+	// Read in the destination address
+	dest, err := readAddrSpec(bufConn)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &Request{
+		Version:  socks5Version,
+		Command:  header[1],
+		DestAddr: dest,
+		bufConn:  bufConn,
+	}
+
+	return request, nil
+}
+
+// requestKey is the context key of the request
+type requestKey struct{}
+
+// WithRequest returns a context carrying the request, passed to the
+// resolver, the rules and Dial
+func WithRequest(ctx context.Context, req *Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// RequestFromContext returns the request being handled, so a custom Dial
+// can use the FQDN, the AuthContext or the client address
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(requestKey{}).(*Request)
+	return req, ok
+}
+
+// configKey is the context key of the server config
+type configKey struct{}
+
+// WithConfig returns a context carrying the server config, so a Dial
+// can resolve names with LookupIP like the server does
+func WithConfig(ctx context.Context, conf *Config) context.Context {
+	return context.WithValue(ctx, configKey{}, conf)
+}
+
+// handleRequest is used for request processing after authentication
+func (s *Server) handleRequest(req *Request, conn conn) error {
+	ctx := WithRequest(WithConfig(context.Background(), s.config), req)
+
+	// Refuse disabled commands before doing any work
+	if !s.config.CommandEnabled(req.Command) {
+		if err := req.sendReply(conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Unsupported command: %s command is disabled", commandName(req.Command))
+	}
+
+	// Resolve the address if we have a FQDN
+	dest := req.DestAddr
+	ctx, err := s.config.ResolveRequest(ctx, req)
+	if err != nil {
+		reply := hostUnreachable
+		if errors.Is(err, ErrNetworkUnreachable) {
+			reply = networkUnreachable
+		}
+		if err := req.sendReply(conn, reply, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to resolve destination '%v': %v", dest, err)
+	}
+
+	// Apply any address rewrites
+	req.realDestAddr = req.DestAddr
+	if s.config.Rewriter != nil {
+		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	}
+
+	// Switch on the command
+	switch req.Command {
+	case ConnectCommand:
+		return s.handleConnect(ctx, conn, req)
+	case BindCommand:
+		return s.handleBind(ctx, conn, req)
+	case AssociateCommand:
+		return s.handleAssociate(ctx, conn, req)
+	default:
+		if err := req.sendReply(conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Unsupported command: %v", req.Command)
+	}
+}
+
+// handleConnect is used to handle a connect command
+func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if ctx_, ok := s.config.AllowRequest(ctx, req); !ok {
+		if err := req.sendReply(conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return blockedByRules(ctx_, "Connect", req.DestAddr)
+	} else {
+		ctx = ctx_
+	}
+
+	// Attempt to connect
+	dial := s.config.Dial
+	if dial == nil {
+		dial = s.config.DirectDial
+	}
+	target, err := s.config.DialAddr(ctx, dial, "tcp", req.realDestAddr)
+	if err != nil {
+		if err := req.sendReply(conn, dialErrorReply(err), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+	}
+	defer target.Close()
+
+	// Send success
+	local := target.LocalAddr().(*net.TCPAddr)
+	bind := AddrSpec{IP: local.IP, Port: local.Port}
+	if err := req.sendReply(conn, successReply, &bind); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	// Start proxying
+	return proxyConns(conn, req, target)
+}
+
+// dialErrorReply selects the reply for a failed connect, from the
+// exported errors or the message of a system error
+func dialErrorReply(err error) uint8 {
+	switch {
+	case errors.Is(err, ErrServerFailure):
+		return serverFailure
+	case errors.Is(err, ErrRuleFailure):
+		return ruleFailure
+	case errors.Is(err, ErrNetworkUnreachable):
+		return networkUnreachable
+	case errors.Is(err, ErrHostUnreachable):
+		return hostUnreachable
+	case errors.Is(err, ErrConnectionRefused):
+		return connectionRefused
+	case errors.Is(err, ErrTTLExpired):
+		return ttlExpired
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "refused") {
+		return connectionRefused
+	} else if strings.Contains(msg, "network is unreachable") {
+		return networkUnreachable
+	}
+	return hostUnreachable
+}
+
+// handleBind is used to handle a bind command
+func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+		if err := req.sendReply(conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return blockedByRules(ctx_, "Bind", req.DestAddr)
+	} else {
+		ctx = ctx_
+	}
+
+	// Listen for the incoming connection
+	var l *net.TCPListener
+	err := s.config.BindPorts.listen(func(port int) error {
+		var err error
+		l, err = net.ListenTCP("tcp", &net.TCPAddr{IP: s.config.BindIP, Port: port})
+		return err
+	})
+	if err != nil {
+		if err := req.sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to listen for bind: %v", err)
+	}
+	defer l.Close()
+
+	// Send the listening address
+	local := l.Addr().(*net.TCPAddr)
+	bind := AddrSpec{IP: s.advertisedIP(conn, local.IP), Port: local.Port}
+	if err := req.sendReply(conn, successReply, &bind); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	// Wait for the expected peer
+	if s.config.BindTimeout > 0 {
+		l.SetDeadline(time.Now().Add(s.config.BindTimeout))
+	}
+	var target *net.TCPConn
+	for {
+		target, err = l.AcceptTCP()
+		if err != nil {
+			if err := req.sendReply(conn, serverFailure, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+			return fmt.Errorf("Bind on %v failed: %v", l.Addr(), err)
+		}
+		peer := target.RemoteAddr().(*net.TCPAddr)
+		if len(req.DestAddr.IP) == 0 || req.DestAddr.IP.IsUnspecified() || req.DestAddr.IP.Equal(peer.IP) {
+			break
+		}
+		s.config.Logger.Printf("[WARN] socks: Rejecting bind connection from %v, expected %v", peer, req.DestAddr.IP)
+		target.Close()
+	}
+	l.Close()
+	defer target.Close()
+
+	// Send the peer address
+	peer := target.RemoteAddr().(*net.TCPAddr)
+	remote := AddrSpec{IP: peer.IP, Port: peer.Port}
+	if err := req.sendReply(conn, successReply, &remote); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	// Start proxying
+	return proxyConns(conn, req, target)
+}
+
+// handleAssociate is used to handle a udp associate command
+func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+		if err := req.sendReply(conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return blockedByRules(ctx_, "Associate", req.DestAddr)
+	} else {
+		ctx = ctx_
+	}
+
+	// Allocate the relay socket
+	var relay *net.UDPConn
+	err := s.config.AssociatePorts.listen(func(port int) error {
+		var err error
+		relay, err = net.ListenUDP("udp", &net.UDPAddr{IP: s.config.BindIP, Port: port})
+		return err
+	})
+	if err != nil {
+		if err := req.sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to allocate udp relay: %v", err)
+	}
+	defer relay.Close()
+
+	// Send success
+	local := relay.LocalAddr().(*net.UDPAddr)
+	bind := AddrSpec{IP: s.advertisedIP(conn, local.IP), Port: local.Port}
+	if err := req.sendReply(conn, successReply, &bind); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	// The association lives as long as the control connection
+	go func() {
+		io.Copy(io.Discard, req.bufConn)
+		relay.Close()
+	}()
+
+	return s.relayUDP(ctx, relay, req)
+}
+
+// readAddrSpec is used to read AddrSpec.
+// Expects an address type byte, follwed by the address and port
+func readAddrSpec(r io.Reader) (*AddrSpec, error) {
+	d := &AddrSpec{}
+
+	// Get the address type
+	addrType := []byte{0}
+	if _, err := r.Read(addrType); err != nil {
+		return nil, err
+	}
+
+	// Handle on a per type basis
+	switch addrType[0] {
+	case ipv4Address:
+		addr := make([]byte, 4)
+		if _, err := io.ReadAtLeast(r, addr, len(addr)); err != nil {
+			return nil, err
+		}
+		d.IP = net.IP(addr)
+
+	case ipv6Address:
+		addr := make([]byte, 16)
+		if _, err := io.ReadAtLeast(r, addr, len(addr)); err != nil {
+			return nil, err
+		}
+		d.IP = net.IP(addr)
+
+	case fqdnAddress:
+		if _, err := r.Read(addrType); err != nil {
+			return nil, err
+		}
+		addrLen := int(addrType[0])
+		fqdn := make([]byte, addrLen)
+		if _, err := io.ReadAtLeast(r, fqdn, addrLen); err != nil {
+			return nil, err
+		}
+		d.FQDN = string(fqdn)
+
+	default:
+		return nil, unrecognizedAddrType
+	}
+
+	// Read the port
+	port := []byte{0, 0}
+	if _, err := io.ReadAtLeast(r, port, 2); err != nil {
+		return nil, err
+	}
+	d.Port = (int(port[0]) << 8) | int(port[1])
+
+	return d, nil
+}
+
+// sendReply is used to send a reply message
+func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	// Format the address
+	addrBody, err := formatAddrSpec(addr)
+	if err != nil {
+		return err
+	}
+
+	// Format the message
+	msg := make([]byte, 3, 3+len(addrBody))
+	msg[0] = socks5Version
+	msg[1] = resp
+	msg[2] = 0 // Reserved
+	msg = append(msg, addrBody...)
+
+	// Send the message
+	_, err = w.Write(msg)
+	return err
+}
+
+// sendReply is used to send a reply message in the protocol
+// version of the request
+func (r *Request) sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	if r.Version == socks4Version {
+		return sendSOCKS4Reply(w, resp, addr)
+	}
+	return sendReply(w, resp, addr)
+}
+
+// formatAddrSpec is used to encode an AddrSpec as an address type byte,
+// follwed by the address and port. A nil AddrSpec encodes as 0.0.0.0:0
+func formatAddrSpec(addr *AddrSpec) ([]byte, error) {
+	var addrType uint8
+	var addrBody []byte
+	var addrPort uint16
+	switch {
+	case addr == nil:
+		addrType = ipv4Address
+		addrBody = []byte{0, 0, 0, 0}
+		addrPort = 0
+
+	case addr.FQDN != "":
+		addrType = fqdnAddress
+		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
+		addrPort = uint16(addr.Port)
+
+	case addr.IP.To4() != nil:
+		addrType = ipv4Address
+		addrBody = []byte(addr.IP.To4())
+		addrPort = uint16(addr.Port)
+
+	case addr.IP.To16() != nil:
+		addrType = ipv6Address
+		addrBody = []byte(addr.IP.To16())
+		addrPort = uint16(addr.Port)
+
+	default:
+		return nil, fmt.Errorf("Failed to format address: %v", addr)
+	}
+
+	msg := make([]byte, 1+len(addrBody)+2)
+	msg[0] = addrType
+	copy(msg[1:], addrBody)
+	msg[1+len(addrBody)] = byte(addrPort >> 8)
+	msg[1+len(addrBody)+1] = byte(addrPort & 0xff)
+	return msg, nil
+}
+
+// proxyConns is used to shuffle data between the client and the target
+// until both directions are done or one of them fails
+func proxyConns(conn conn, req *Request, target net.Conn) error {
+	return Relay(conn, req.bufConn, target)
+}
+
+// Relay is used to shuffle data between a client, read from src and
+// written to dst, and the target until both directions are done or
+// one of them fails
+func Relay(dst io.Writer, src io.Reader, target io.ReadWriter) error {
+	errCh := make(chan error, 2)
+	go proxy(target, src, errCh)
+	go proxy(dst, target, errCh)
+
+	// Wait
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if e != nil {
+			// return from this function closes target (and conn).
+			return e
+		}
+	}
+	return nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// proxy is used to suffle data from src to destination, and sends errors
+// down a dedicated channel
+func proxy(dst io.Writer, src io.Reader, errCh chan error) {
+	_, err := io.Copy(dst, src)
+	if tcpConn, ok := dst.(closeWriter); ok {
+		tcpConn.CloseWrite()
+	}
+	errCh <- err
+}
@@ -21,3 +21,16 @@ func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context,
 	}
 	return ctx, addr.IP, err
 }
+
+// ResolveAll returns every A and AAAA record of the name
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ctx, ips, nil
+}
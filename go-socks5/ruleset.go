@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// RuleSet is used to provide custom rules to allow or prohibit actions
+type RuleSet interface {
+	Allow(ctx context.Context, req *Request) (context.Context, bool)
+}
+
+// DestIPRuleSet is implemented by rule sets telling whether they check
+// the destination IP, so names a remote resolving Dial gets are only
+// resolved locally when the rules need the IP
+type DestIPRuleSet interface {
+	RuleSet
+	UsesDestIP() bool
+}
+
+// UsesDestIP reports whether the rules check the destination IP,
+// rule sets not implementing DestIPRuleSet are assumed to
+func UsesDestIP(rules RuleSet) bool {
+	if r, ok := rules.(DestIPRuleSet); ok {
+		return r.UsesDestIP()
+	}
+	return rules != nil
+}
+
+// PermitAll returns a RuleSet which allows all types of connections
+func PermitAll() RuleSet {
+	return &PermitCommand{true, true, true}
+}
+
+// PermitNone returns a RuleSet which disallows all types of connections
+func PermitNone() RuleSet {
+	return &PermitCommand{false, false, false}
+}
+
+// PermitCommand is an implementation of the RuleSet which
+// enables filtering supported commands
+type PermitCommand struct {
+	EnableConnect   bool
+	EnableBind      bool
+	EnableAssociate bool
+}
+
+func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	var allow bool
+	switch req.Command {
+	case ConnectCommand:
+		allow = p.EnableConnect
+	case BindCommand:
+		allow = p.EnableBind
+	case AssociateCommand:
+		allow = p.EnableAssociate
+	}
+	if !allow {
+		ctx = WithRuleReason(ctx, fmt.Sprintf("%s command is disabled", commandName(req.Command)))
+	}
+	return ctx, allow
+}
+
+// UsesDestIP is false, only the command is checked
+func (p *PermitCommand) UsesDestIP() bool {
+	return false
+}
+
+// commandName returns the name of the command for logs
+func commandName(command uint8) string {
+	switch command {
+	case ConnectCommand:
+		return "connect"
+	case BindCommand:
+		return "bind"
+	case AssociateCommand:
+		return "associate"
+	}
+	return fmt.Sprintf("unknown (%d)", command)
+}
+
+// ruleReasonKey is the context key of the rule reason
+type ruleReasonKey struct{}
+
+// WithRuleReason returns a context annotated with the reason a rule
+// allowed or denied the request
+func WithRuleReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, ruleReasonKey{}, reason)
+}
+
+// RuleReason returns the reason annotated by the last deciding rule,
+// if any
+func RuleReason(ctx context.Context) string {
+	reason, _ := ctx.Value(ruleReasonKey{}).(string)
+	return reason
+}
+
+// ruleFunc adapts a function to the RuleSet interface
+type ruleFunc func(ctx context.Context, req *Request) (context.Context, bool)
+
+func (f ruleFunc) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return f(ctx, req)
+}
+
+// composedRule is a RuleSet built from other rules, which uses the
+// destination IP when any of them does
+type composedRule struct {
+	ruleFunc
+	rules []RuleSet
+}
+
+func (c composedRule) UsesDestIP() bool {
+	for _, rule := range c.rules {
+		if UsesDestIP(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllOf returns a RuleSet which allows requests allowed by all of the
+// rules, they are evaluated in order until the first one denies
+func AllOf(rules ...RuleSet) RuleSet {
+	return composedRule{rules: rules, ruleFunc: func(ctx context.Context, req *Request) (context.Context, bool) {
+		for _, rule := range rules {
+			var ok bool
+			if ctx, ok = rule.Allow(ctx, req); !ok {
+				return ctx, false
+			}
+		}
+		return ctx, true
+	}}
+}
+
+// AnyOf returns a RuleSet which allows requests allowed by any of the
+// rules, they are evaluated in order until the first one allows. Denied
+// requests keep the reason of the last rule.
+func AnyOf(rules ...RuleSet) RuleSet {
+	return composedRule{rules: rules, ruleFunc: func(ctx context.Context, req *Request) (context.Context, bool) {
+		denied := ctx
+		for _, rule := range rules {
+			ctx_, ok := rule.Allow(ctx, req)
+			if ok {
+				return ctx_, true
+			}
+			denied = ctx_
+		}
+		return denied, false
+	}}
+}
+
+// Not returns a RuleSet which denies the requests allowed by
+// the rule, and allows the ones it denies
+func Not(rule RuleSet) RuleSet {
+	return composedRule{rules: []RuleSet{rule}, ruleFunc: func(ctx context.Context, req *Request) (context.Context, bool) {
+		ctx_, ok := rule.Allow(ctx, req)
+		if reason := RuleReason(ctx_); reason != RuleReason(ctx) {
+			ctx_ = WithRuleReason(ctx_, "not ("+reason+")")
+		}
+		return ctx_, !ok
+	}}
+}
+
+// WithReason returns a RuleSet which annotates the decisions of the rule
+// with the reason, unless the rule gave its own
+func WithReason(rule RuleSet, reason string) RuleSet {
+	return composedRule{rules: []RuleSet{rule}, ruleFunc: func(ctx context.Context, req *Request) (context.Context, bool) {
+		ctx_, ok := rule.Allow(ctx, req)
+		if RuleReason(ctx_) == RuleReason(ctx) {
+			ctx_ = WithRuleReason(ctx_, reason)
+		}
+		return ctx_, ok
+	}}
+}
+
+// blockedByRules formats the error of a request denied by the rules,
+// with the reason of the rule when there is one
+func blockedByRules(ctx context.Context, command string, dest *AddrSpec) error {
+	if reason := RuleReason(ctx); reason != "" {
+		return fmt.Errorf("%s to %v blocked by rules: %s", command, dest, reason)
+	}
+	return fmt.Errorf("%s to %v blocked by rules", command, dest)
+}
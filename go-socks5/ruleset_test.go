@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestPermitCommand(t *testing.T) {
+	ctx := context.Background()
+	r := &PermitCommand{true, false, false}
+
+	if _, ok := r.Allow(ctx, &Request{Command: ConnectCommand}); !ok {
+		t.Fatalf("expect connect")
+	}
+
+	if _, ok := r.Allow(ctx, &Request{Command: BindCommand}); ok {
+		t.Fatalf("do not expect bind")
+	}
+
+	if _, ok := r.Allow(ctx, &Request{Command: AssociateCommand}); ok {
+		t.Fatalf("do not expect associate")
+	}
+}
+
+func TestRuleCombinators(t *testing.T) {
+	ctx := context.Background()
+	connectOnly := &PermitCommand{true, false, false}
+	bindOnly := &PermitCommand{false, true, false}
+	connect := &Request{Command: ConnectCommand}
+	bind := &Request{Command: BindCommand}
+
+	if _, ok := AllOf(connectOnly, PermitAll()).Allow(ctx, connect); !ok {
+		t.Fatalf("expect connect")
+	}
+	ctx_, ok := AllOf(PermitAll(), connectOnly).Allow(ctx, bind)
+	if ok {
+		t.Fatalf("do not expect bind")
+	}
+	if reason := RuleReason(ctx_); reason != "bind command is disabled" {
+		t.Fatalf("bad reason: %q", reason)
+	}
+
+	if _, ok := AnyOf(connectOnly, bindOnly).Allow(ctx, bind); !ok {
+		t.Fatalf("expect bind")
+	}
+	if _, ok := AnyOf(connectOnly, bindOnly).Allow(ctx, &Request{Command: AssociateCommand}); ok {
+		t.Fatalf("do not expect associate")
+	}
+
+	ctx_, ok = Not(bindOnly).Allow(ctx, connect)
+	if !ok {
+		t.Fatalf("expect connect")
+	}
+	if reason := RuleReason(ctx_); reason != "not (connect command is disabled)" {
+		t.Fatalf("bad reason: %q", reason)
+	}
+
+	ctx_, ok = WithReason(PermitNone(), "custom").Allow(ctx, connect)
+	if ok || RuleReason(ctx_) != "connect command is disabled" {
+		t.Fatalf("rule reason must be kept: %q", RuleReason(ctx_))
+	}
+	ctx_, _ = WithReason(PermitAll(), "custom").Allow(ctx, connect)
+	if RuleReason(ctx_) != "custom" {
+		t.Fatalf("bad reason: %q", RuleReason(ctx_))
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package socks5
+
+import "syscall"
+
+const sockoptSupported = true
+
+// sourceControl returns a dialer control binding sockets to the
+// interface and allowing non-local source IPs, nil when not needed
+func sourceControl(iface string, freeBind bool) func(network, address string, c syscall.RawConn) error {
+	if iface == "" && !freeBind {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+			}
+			if err == nil && freeBind {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+			}
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}
+}
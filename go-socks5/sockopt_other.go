@@ -0,0 +1,21 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const sockoptSupported = false
+
+// sourceControl returns a dialer control failing when socket options
+// are needed, SO_BINDTODEVICE and IP_FREEBIND are Linux only
+func sourceControl(iface string, freeBind bool) func(network, address string, c syscall.RawConn) error {
+	if iface == "" && !freeBind {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("Source interface and free bind are only supported on Linux")
+	}
+}
@@ -0,0 +1,171 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+const (
+	socks4Version  = uint8(4)
+	socks4ReplyVer = uint8(0)
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+
+	// maxSOCKS4Field limits the null terminated USERID and hostname fields
+	maxSOCKS4Field = 255
+)
+
+var (
+	socks4AuthFailed = fmt.Errorf("SOCKS4 USERID is not a valid user:password pair")
+)
+
+// serveSOCKS4 is used to serve a SOCKS4 or SOCKS4a request
+// after the version byte has been read
+func (s *Server) serveSOCKS4(conn net.Conn, bufConn *bufio.Reader) error {
+	request, userID, err := newSOCKS4Request(bufConn)
+	if err != nil {
+		err = fmt.Errorf("Failed to read SOCKS4 request: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	// Authenticate the connection
+	authContext, err := s.authenticateSOCKS4(userID, conn.RemoteAddr())
+	if err != nil {
+		if err == socks4AuthFailed {
+			s.authFailed(conn.RemoteAddr())
+		}
+		sendSOCKS4Reply(conn, ruleFailure, nil)
+		err = fmt.Errorf("Failed to authenticate: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+	request.AuthContext = authContext
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+
+	// Process the client request
+	if err := s.handleRequest(request, conn); err != nil {
+		err = fmt.Errorf("Failed to handle request: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// newSOCKS4Request is used to read a SOCKS4 request, the
+// version byte is expected to be consumed already
+func newSOCKS4Request(bufConn *bufio.Reader) (*Request, string, error) {
+	// Read the command, port and IP
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(bufConn, header); err != nil {
+		return nil, "", err
+	}
+	command := header[0]
+	if command != ConnectCommand && command != BindCommand {
+		return nil, "", fmt.Errorf("Unsupported command: %v", command)
+	}
+	dest := &AddrSpec{
+		IP:   net.IP(header[3:7]),
+		Port: (int(header[1]) << 8) | int(header[2]),
+	}
+
+	userID, err := readNullTerminated(bufConn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// SOCKS4a sends the hostname after the USERID with an IP of 0.0.0.x
+	if dest.IP[0] == 0 && dest.IP[1] == 0 && dest.IP[2] == 0 && dest.IP[3] != 0 {
+		if dest.FQDN, err = readNullTerminated(bufConn); err != nil {
+			return nil, "", err
+		}
+		dest.IP = nil
+	}
+
+	request := &Request{
+		Version:  socks4Version,
+		Command:  command,
+		DestAddr: dest,
+		bufConn:  bufConn,
+	}
+	return request, userID, nil
+}
+
+// authenticateSOCKS4 is used to authenticate a SOCKS4 client by its USERID.
+// Anonymous clients are only accepted when the NoAuthAuthenticator is enabled.
+func (s *Server) authenticateSOCKS4(userID string, remote net.Addr) (*AuthContext, error) {
+	switch s.authMethods[NoAuth].(type) {
+	case NoAuthAuthenticator, *NoAuthAuthenticator:
+		return &AuthContext{NoAuth, nil}, nil
+	}
+
+	var creds CredentialStore
+	switch cator := s.authMethods[UserPassAuth].(type) {
+	case UserPassAuthenticator:
+		creds = cator.Credentials
+	case *UserPassAuthenticator:
+		creds = cator.Credentials
+	}
+	if creds == nil {
+		return nil, NoSupportedAuth
+	}
+
+	user, password, ok := strings.Cut(userID, ":")
+	if !ok {
+		return nil, socks4AuthFailed
+	}
+	attributes, valid, err := CheckCredentials(creds, user, password, remote)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", UserAuthUnavailable, err)
+	}
+	if !valid {
+		return nil, socks4AuthFailed
+	}
+	return UserPassContext(user, attributes), nil
+}
+
+// readNullTerminated is used to read one of the null terminated
+// SOCKS4 fields
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) == maxSOCKS4Field {
+			return "", fmt.Errorf("SOCKS4 field exceeds %d bytes", maxSOCKS4Field)
+		}
+		field = append(field, b)
+	}
+}
+
+// sendSOCKS4Reply is used to send a SOCKS4 reply message. SOCKS4 has
+// no reply codes for specific failures, and can only carry IPv4 addresses.
+func sendSOCKS4Reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	msg := make([]byte, 8)
+	msg[0] = socks4ReplyVer
+	msg[1] = socks4Rejected
+	if resp == successReply {
+		msg[1] = socks4Granted
+	}
+	if addr != nil {
+		if ip := addr.IP.To4(); ip != nil {
+			msg[2] = byte(addr.Port >> 8)
+			msg[3] = byte(addr.Port & 0xff)
+			copy(msg[4:], ip)
+		}
+	}
+
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func socks4Server(t *testing.T, conf *Config) net.Listener {
+	conf.EnableSOCKS4 = true
+	conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	return l
+}
+
+func TestSOCKS4a_Connect(t *testing.T) {
+	// Create a local listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+	lAddr := target.Addr().(*net.TCPAddr)
+
+	creds := StaticCredentials{
+		"foo": "bar",
+	}
+	l := socks4Server(t, &Config{Credentials: creds})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Connect by hostname, authenticated by the USERID
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{4, ConnectCommand})
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	req.Write(port)
+	req.Write([]byte{0, 0, 0, 1})
+	req.WriteString("foo:bar\x00localhost\x00")
+	conn.Write(req.Bytes())
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 12)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[0] != socks4ReplyVer || out[1] != socks4Granted {
+		t.Fatalf("bad: %v", out)
+	}
+	if !bytes.Equal(out[8:], []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS4_AuthRequired(t *testing.T) {
+	creds := StaticCredentials{
+		"foo": "bar",
+	}
+	l := socks4Server(t, &Config{Credentials: creds})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{4, ConnectCommand, 0, 80, 127, 0, 0, 1, 'f', 'o', 'o', 0})
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 8)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks4ReplyVer, socks4Rejected, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS4_Disabled(t *testing.T) {
+	serv, _ := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{4, ConnectCommand, 0, 80, 127, 0, 0, 1, 0})
+
+	// The connection is closed without a reply
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+}
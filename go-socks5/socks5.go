@@ -0,0 +1,354 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	socks5Version = uint8(5)
+)
+
+// Config is used to setup and configure a Server
+type Config struct {
+	// AuthMethods can be provided to implement custom authentication
+	// By default, "auth-less" mode is enabled.
+	// For password-based auth use UserPassAuthenticator.
+	AuthMethods []Authenticator
+
+	// If provided, username/password authentication is enabled,
+	// by appending a UserPassAuthenticator to AuthMethods. If not provided,
+	// and AUthMethods is nil, then "auth-less" mode is enabled.
+	Credentials CredentialStore
+
+	// Resolver can be provided to do custom name resolution.
+	// Defaults to DNSResolver if not provided.
+	Resolver NameResolver
+
+	// IPFamily selects the address families of destinations and
+	// the order they are dialed in: PreferIPv4, PreferIPv6, IPv4Only
+	// or IPv6Only. Defaults to PreferIPv4.
+	IPFamily uint8
+
+	// HappyEyeballsDelay is how long a connection attempt runs before
+	// the next resolved address is tried. Defaults to 250ms.
+	HappyEyeballsDelay time.Duration
+
+	// Rules is provided to enable custom logic around permitting
+	// various commands. If not provided, PermitAll is used.
+	Rules RuleSet
+
+	// Rewriter can be used to transparently rewrite addresses.
+	// This is invoked before the RuleSet is invoked.
+	// Defaults to NoRewrite.
+	Rewriter AddressRewriter
+
+	// BindIP is used for bind or udp associate
+	BindIP net.IP
+
+	// BindPorts limits the ports used to listen for bind connections.
+	// Defaults to any free port.
+	BindPorts PortRange
+
+	// BindTimeout limits how long bind waits for the incoming connection.
+	// Defaults to no timeout.
+	BindTimeout time.Duration
+
+	// AssociatePorts limits the ports used for udp associate relays.
+	// Defaults to any free port.
+	AssociatePorts PortRange
+
+	// Logger can be used to provide a custom log target.
+	// Defaults to stdout.
+	Logger *log.Logger
+
+	// EnableSOCKS4 allows SOCKS4 and SOCKS4a clients on the same listener.
+	// Without the NoAuth method they have to send "user:password"
+	// as USERID, checked against the username/password credentials.
+	EnableSOCKS4 bool
+
+	// Commands limits the commands served, others are answered with
+	// commandNotSupported. Defaults to all supported commands.
+	Commands []uint8
+
+	// OnAuthFailure is called when a client fails username/password
+	// authentication, e.g. to ban brute-forcing clients.
+	OnAuthFailure func(remote net.Addr)
+
+	// SourceIPv4 and SourceIPv6 are the local addresses of outbound
+	// connections of the default Dial, by destination address family.
+	// Defaults to the address chosen by the system. BIND listeners and
+	// UDP ASSOCIATE relay sockets use BindIP instead, and DNS queries of
+	// the Resolver are not affected.
+	SourceIPv4 net.IP
+	SourceIPv6 net.IP
+
+	// SourceInterface binds outbound connections of the default Dial
+	// to a network interface with SO_BINDTODEVICE, only on Linux. Like
+	// the source IPs it only applies to CONNECT.
+	SourceInterface string
+
+	// SelectSourceIP can choose the source IP of each outbound connection
+	// of the default Dial, e.g. from a pool. A nil IP falls back to
+	// SourceIPv4 or SourceIPv6.
+	SelectSourceIP func(ctx context.Context, dest net.IP) net.IP
+
+	// FreeBind allows source IPs not assigned to the host, like the
+	// addresses of a routed prefix, with IP_FREEBIND. Only on Linux.
+	FreeBind bool
+
+	// Optional function for dialing out
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// RemoteResolve passes the FQDN of connect destinations to Dial, for
+	// a Dial resolving names itself like an upstream proxy. Names are only
+	// resolved locally when the rules check the destination IP, and the
+	// checked IPs are dialed instead.
+	RemoteResolve bool
+}
+
+// Server is reponsible for accepting connections and handling
+// the details of the SOCKS5 protocol
+type Server struct {
+	config      *Config
+	authMethods map[uint8]Authenticator
+	isIPAllowed func(net.IP) bool
+}
+
+// New creates a new Server and potentially returns an error
+func New(conf *Config) (*Server, error) {
+	// Ensure we have at least one authentication method enabled
+	if len(conf.AuthMethods) == 0 {
+		if conf.Credentials != nil {
+			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
+		} else {
+			conf.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
+		}
+	}
+
+	// Ensure we have a DNS resolver
+	if conf.Resolver == nil {
+		conf.Resolver = DNSResolver{}
+	}
+
+	// Ensure we have a rule set
+	if conf.Rules == nil {
+		conf.Rules = PermitAll()
+	}
+
+	// Ensure the source socket options can be used
+	if (conf.SourceInterface != "" || conf.FreeBind) && !sockoptSupported {
+		return nil, fmt.Errorf("SourceInterface and FreeBind are only supported on Linux")
+	}
+
+	// Ensure we have a log target
+	if conf.Logger == nil {
+		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+
+	server := &Server{
+		config: conf,
+	}
+
+	server.authMethods = make(map[uint8]Authenticator)
+
+	for _, a := range conf.AuthMethods {
+		server.authMethods[a.GetCode()] = a
+	}
+
+	// Set default IP whitelist function
+	server.isIPAllowed = func(ip net.IP) bool {
+		return true // default allow all IPs
+	}
+
+	return server, nil
+}
+
+// ListenAndServe is used to create a listener and serve on it
+func (s *Server) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve is used to serve connections from a listener
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// SetIPWhitelist sets the function to check if a given IP is allowed
+func (s *Server) SetIPWhitelist(allowedIPs []net.IP) {
+	s.SetIPFilter(func(ip net.IP) bool {
+		for _, allowedIP := range allowedIPs {
+			if ip.Equal(allowedIP) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// SetIPFilter sets a custom function to check if a given client IP is allowed
+func (s *Server) SetIPFilter(allowed func(ip net.IP) bool) {
+	s.isIPAllowed = allowed
+}
+
+// IsIPAllowed checks the IP against the whitelist
+func (s *Server) IsIPAllowed(ip net.IP) bool {
+	return s.isIPAllowed(ip)
+}
+
+// CommandEnabled checks if the command is served according to Commands
+func (c *Config) CommandEnabled(command uint8) bool {
+	if c.Commands == nil {
+		return true
+	}
+	for _, enabled := range c.Commands {
+		if enabled == command {
+			return true
+		}
+	}
+	return false
+}
+
+// DirectDial connects to addr from the source IP selected for the request,
+// or matching the family of the destination, and from the source
+// interface. Names are resolved with the Resolver and their addresses
+// raced like the server does. It is the default Dial.
+func (c *Config) DirectDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil || !strings.HasPrefix(network, "tcp") {
+		return c.dialIP(ctx, network, addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reuse the addresses resolved for the request
+	dest := &AddrSpec{FQDN: host, Port: port}
+	if req, ok := RequestFromContext(ctx); ok && req.DestAddr.FQDN == host && req.DestAddr.IP != nil {
+		dest.IP, dest.IPs = req.DestAddr.IP, req.DestAddr.IPs
+	} else if ctx, err = c.ResolveAddr(ctx, dest); err != nil {
+		return nil, err
+	}
+	return c.dialAll(ctx, c.dialIP, network, dest)
+}
+
+// dialIP connects to an IP address with the source IP and interface
+func (c *Config) dialIP(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Control: sourceControl(c.SourceInterface, c.FreeBind)}
+	if host, _, err := net.SplitHostPort(addr); err == nil && strings.HasPrefix(network, "tcp") {
+		if ip := net.ParseIP(host); ip != nil {
+			var source net.IP
+			if c.SelectSourceIP != nil {
+				source = c.SelectSourceIP(ctx, ip)
+			}
+			if source == nil && ip.To4() != nil {
+				source = c.SourceIPv4
+			} else if source == nil {
+				source = c.SourceIPv6
+			}
+			if source != nil {
+				dialer.LocalAddr = &net.TCPAddr{IP: source}
+			}
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// authFailed reports a failed login to the OnAuthFailure hook
+func (s *Server) authFailed(remote net.Addr) {
+	if s.config.OnAuthFailure != nil {
+		s.config.OnAuthFailure(remote)
+	}
+}
+
+// ServeConn is used to serve a single connection.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	bufConn := bufio.NewReader(conn)
+
+	// Check client IP against whitelist
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		s.config.Logger.Printf("[ERR] socks: Failed to get client IP address: %v", err)
+		return err
+	}
+	ip := net.ParseIP(clientIP)
+	if s.isIPAllowed(ip) {
+		s.config.Logger.Printf("[INFO] socks: Connection from allowed IP address: %s", clientIP)
+	} else {
+		s.config.Logger.Printf("[WARN] socks: Connection from not allowed IP address: %s", clientIP)
+		return fmt.Errorf("connection from not allowed IP address")
+	}
+
+	// Read the version byte
+	version := []byte{0}
+	if _, err := bufConn.Read(version); err != nil {
+		s.config.Logger.Printf("[ERR] socks: Failed to get version byte: %v", err)
+		return err
+	}
+
+	// SOCKS4 clients have their own request format
+	if version[0] == socks4Version && s.config.EnableSOCKS4 {
+		return s.serveSOCKS4(conn, bufConn)
+	}
+
+	// Ensure we are compatible
+	if version[0] != socks5Version {
+		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	// Authenticate the connection
+	authContext, err := s.authenticate(conn, bufConn)
+	if err != nil {
+		if err == UserAuthFailed {
+			s.authFailed(conn.RemoteAddr())
+		}
+		err = fmt.Errorf("Failed to authenticate: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	request, err := NewRequest(bufConn)
+	if err != nil {
+		if err == unrecognizedAddrType {
+			if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+		}
+		return fmt.Errorf("Failed to read destination address: %v", err)
+	}
+	request.AuthContext = authContext
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+
+	// Process the client request
+	if err := s.handleRequest(request, conn); err != nil {
+		err = fmt.Errorf("Failed to handle request: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	return nil
+}
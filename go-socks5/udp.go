@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxUDPPacket is the largest datagram the relay can receive
+	maxUDPPacket = 64 * 1024
+
+	// maxUDPTargets limits how many destinations and reply
+	// addresses are remembered for a single association
+	maxUDPTargets = 1024
+)
+
+var (
+	fragmentedDatagram = fmt.Errorf("Fragmented datagrams are not supported")
+	shortDatagram      = fmt.Errorf("Datagram is too short")
+)
+
+// udpTarget is a destination the client has sent datagrams to,
+// a nil addr means the destination was blocked by the rules
+type udpTarget struct {
+	addr *net.UDPAddr
+}
+
+// advertisedIP returns the address sent back to the client for sockets
+// listening on ip. Unspecified addresses are replaced by the local
+// address of the control connection.
+func (s *Server) advertisedIP(conn conn, ip net.IP) net.IP {
+	if !ip.IsUnspecified() {
+		return ip
+	}
+	if local, ok := conn.(interface{ LocalAddr() net.Addr }); ok {
+		if tcp, ok := local.LocalAddr().(*net.TCPAddr); ok {
+			return tcp.IP
+		}
+	}
+	return ip
+}
+
+// relayUDP is used to shuffle datagrams between the client and the
+// destinations until the relay socket is closed
+func (s *Server) relayUDP(ctx context.Context, relay *net.UDPConn, req *Request) error {
+	// Only the client who opened the association may use the relay,
+	// the request may narrow it down to a single source port
+	var clientIP net.IP
+	if req.RemoteAddr != nil {
+		clientIP = req.RemoteAddr.IP
+	}
+	clientPort := 0
+	if req.DestAddr != nil && !req.DestAddr.IP.IsUnspecified() {
+		clientPort = req.DestAddr.Port
+	}
+
+	var client *net.UDPAddr
+	targets := make(map[string]udpTarget)
+	replies := make(map[string]bool)
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("Failed to read datagram: %v", err)
+		}
+
+		switch {
+		case client != nil && addrEqual(from, client):
+		case replies[from.String()]:
+			// Datagram from a destination, send it back to the client
+			header, err := formatUDPHeader(&AddrSpec{IP: from.IP, Port: from.Port})
+			if err != nil {
+				continue
+			}
+			if _, err := relay.WriteToUDP(append(header, buf[:n]...), client); err != nil {
+				s.config.Logger.Printf("[ERR] socks: Failed to relay datagram to %v: %v", client, err)
+			}
+			continue
+		case client == nil && (clientIP == nil || clientIP.Equal(from.IP)) && (clientPort == 0 || clientPort == from.Port):
+			client = from
+		default:
+			continue
+		}
+
+		// Datagram from the client
+		dest, data, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			s.config.Logger.Printf("[WARN] socks: Dropping datagram from %v: %v", from, err)
+			continue
+		}
+
+		key := dest.Address()
+		target, ok := targets[key]
+		if !ok {
+			target = s.udpTarget(ctx, req, dest)
+			if len(targets) >= maxUDPTargets || len(replies) >= maxUDPTargets {
+				targets = make(map[string]udpTarget)
+				replies = make(map[string]bool)
+			}
+			targets[key] = target
+		}
+		if target.addr == nil {
+			continue
+		}
+
+		replies[target.addr.String()] = true
+		if _, err := relay.WriteToUDP(data, target.addr); err != nil {
+			s.config.Logger.Printf("[ERR] socks: Failed to relay datagram to %v: %v", target.addr, err)
+		}
+	}
+}
+
+// udpTarget resolves a datagram destination and checks it against the
+// rules like a connect, the first allowed address is used
+func (s *Server) udpTarget(ctx context.Context, req *Request, dest *AddrSpec) udpTarget {
+	if _, err := s.config.ResolveAddr(ctx, dest); err != nil {
+		s.config.Logger.Printf("[ERR] socks: Failed to resolve destination '%v': %v", dest, err)
+		return udpTarget{}
+	}
+	if dest.IP == nil || dest.IP.IsUnspecified() || dest.Port == 0 {
+		s.config.Logger.Printf("[WARN] socks: Datagram to invalid destination %v dropped", dest)
+		return udpTarget{}
+	}
+
+	datagram := &Request{
+		Version:     req.Version,
+		Command:     AssociateCommand,
+		AuthContext: req.AuthContext,
+		RemoteAddr:  req.RemoteAddr,
+		DestAddr:    dest,
+		Datagram:    true,
+	}
+	if ctx_, ok := s.config.AllowRequest(ctx, datagram); !ok {
+		s.config.Logger.Printf("[WARN] socks: %v", blockedByRules(ctx_, "Datagram", dest))
+		return udpTarget{}
+	}
+	return udpTarget{addr: &net.UDPAddr{IP: dest.IP, Port: dest.Port}}
+}
+
+// parseUDPHeader is used to split a client datagram into its
+// destination and payload.
+// Expects the reserved bytes, fragment number and the address
+func parseUDPHeader(b []byte) (*AddrSpec, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, shortDatagram
+	}
+	if b[2] != 0 {
+		return nil, nil, fragmentedDatagram
+	}
+
+	r := bytes.NewReader(b[3:])
+	dest, err := readAddrSpec(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dest, b[len(b)-r.Len():], nil
+}
+
+// formatUDPHeader is used to build the header prepended to datagrams
+// sent back to the client
+func formatUDPHeader(addr *AddrSpec) ([]byte, error) {
+	addrBody, err := formatAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{0, 0, 0}, addrBody...), nil
+}
+
+func addrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
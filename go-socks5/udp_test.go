@@ -0,0 +1,144 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestUDPHeader(t *testing.T) {
+	header, err := formatUDPHeader(&AddrSpec{FQDN: "example.com", Port: 53})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dest, data, err := parseUDPHeader(append(header, "ping"...))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dest.FQDN != "example.com" || dest.Port != 53 {
+		t.Fatalf("bad: %v", dest)
+	}
+	if !bytes.Equal(data, []byte("ping")) {
+		t.Fatalf("bad: %v", data)
+	}
+
+	if _, _, err := parseUDPHeader([]byte{0, 0, 1, 1, 127, 0, 0, 1, 0, 53}); err != fragmentedDatagram {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := parseUDPHeader([]byte{0, 0}); err != shortDatagram {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_Associate(t *testing.T) {
+	// Create a local udp echo server
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(append([]byte("re:"), buf[:n]...), from)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	// Create a socks server
+	conf := &Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// Get a local conn and open the association
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, NoAuth})
+	conn.Write([]byte{5, AssociateCommand, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 12)
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[:6], []byte{socks5Version, NoAuth, 5, successReply, 0, ipv4Address}) {
+		t.Fatalf("bad: %v", out)
+	}
+	relayAddr := &net.UDPAddr{
+		IP:   net.IP(out[6:10]),
+		Port: int(out[10])<<8 | int(out[11]),
+	}
+
+	// Send a datagram through the relay
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	header, _ := formatUDPHeader(&AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port})
+	if _, err := client.Write(append(header, "ping"...)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := append(header, "re:ping"...)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("bad: %v %v", buf[:n], expected)
+	}
+}
+
+func TestUDPTarget(t *testing.T) {
+	conf := &Config{
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Resolver: staticResolver{net.ParseIP("10.0.0.1"), net.ParseIP("192.0.2.1")},
+		Rules: ruleFunc(func(ctx context.Context, req *Request) (context.Context, bool) {
+			return ctx, req.Datagram && !req.DestAddr.IP.IsPrivate()
+		}),
+		RemoteResolve: true,
+	}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req := &Request{Command: AssociateCommand}
+
+	// Like a connect, the allowed address of the name is used
+	target := s.udpTarget(context.Background(), req, &AddrSpec{FQDN: "example.com", Port: 53})
+	if target.addr == nil || target.addr.String() != "192.0.2.1:53" {
+		t.Fatalf("bad target %v", target.addr)
+	}
+	if target := s.udpTarget(context.Background(), req, &AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 53}); target.addr != nil {
+		t.Fatalf("blocked target %v", target.addr)
+	}
+}
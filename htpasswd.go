@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdCredentials is a CredentialStore backed by a htpasswd file with
+// bcrypt, SHA-256/512 crypt or argon2id entries, reloaded when the file changes
+type htpasswdCredentials struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string
+	// dummy is the hash of one of the users, verified for unknown users
+	// so that the response time does not reveal which users exist
+	dummy string
+}
+
+// newHtpasswdCredentials loads the htpasswd file and starts watching it
+func newHtpasswdCredentials(path string) (*htpasswdCredentials, error) {
+	h := &htpasswdCredentials{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	watchFiles(func() {
+		if err := h.reload(); err != nil {
+			log.Printf("[ERR] htpasswd: Failed to reload %s, keeping the previous users: %v", h.path, err)
+			return
+		}
+		log.Printf("[INFO] htpasswd: Reloaded users from %s", h.path)
+	}, path)
+	return h, nil
+}
+
+func (h *htpasswdCredentials) reload() error {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return err
+	}
+	var dummy string
+	for _, hashed := range users {
+		dummy = hashed
+		break
+	}
+	h.mu.Lock()
+	h.users, h.dummy = users, dummy
+	h.mu.Unlock()
+	return nil
+}
+
+// parseHtpasswd parses "user:hash" lines, skipping blank lines and comments
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hashed, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if !supportedHash(hashed) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %q", n, user)
+		}
+		users[user] = hashed
+	}
+	return users, scanner.Err()
+}
+
+func supportedHash(hashed string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$", "$argon2id$"} {
+		if strings.HasPrefix(hashed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *htpasswdCredentials) Valid(user, password string) bool {
+	h.mu.RLock()
+	hashed, ok := h.users[user]
+	dummy := h.dummy
+	h.mu.RUnlock()
+	if !ok {
+		if dummy != "" {
+			verifyPassword(dummy, password)
+		}
+		return false
+	}
+
+	valid, err := verifyPassword(hashed, password)
+	if err != nil {
+		log.Printf("[ERR] htpasswd: Failed to verify password of %q: %v", user, err)
+	}
+	return valid
+}
+
+// verifyPassword compares the password to the hash in constant time
+func verifyPassword(hashed, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		return verifySHACrypt(hashed, password)
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return verifyArgon2id(hashed, password)
+	}
+	return false, fmt.Errorf("unsupported hash")
+}
+
+// verifyArgon2id checks a password against a PHC formatted argon2id hash,
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func verifyArgon2id(hashed, password string) (bool, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2id parameters: %v", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id hash: %v", err)
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
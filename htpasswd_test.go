@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shaCryptVectors are the test vectors of the SHA-crypt specification,
+// the rounds=10 vectors are stored with the minimum of 1000 rounds
+var shaCryptVectors = []struct {
+	password string
+	hashed   string
+}{
+	{"Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+	{"Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+	{"This is just a test", "$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+	{"a very much longer text to encrypt.  This one even stretches over morethan one line.", "$5$rounds=1400$anotherlongsalts$Rx.j8H.h8HjEDGomFU8bDkXm3XIUnzyxf12oP84Bnq1"},
+	{"we have a short salt string but not a short password", "$5$rounds=77777$short$JiO1O3ZpDAxGJeaDIuqCoEFysAe1mZNJRs3pw0KQRd/"},
+	{"a short string", "$5$rounds=123456$asaltof16chars..$gP3VQ/6X7UUEW3HkBn2w1/Ptq2jxPyzV/cZKmF/wJvD"},
+	{"the minimum number is still observed", "$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC"},
+	{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	{"This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	{"a very much longer text to encrypt.  This one even stretches over morethan one line.", "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+	{"we have a short salt string but not a short password", "$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	{"a short string", "$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+	{"the minimum number is still observed", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+}
+
+func TestSHACrypt(t *testing.T) {
+	for _, tc := range shaCryptVectors {
+		ok, err := verifyPassword(tc.hashed, tc.password)
+		if err != nil || !ok {
+			t.Errorf("%s: got %v, %v", tc.hashed, ok, err)
+		}
+		if ok, _ := verifyPassword(tc.hashed, tc.password+"!"); ok {
+			t.Errorf("%s: wrong password accepted", tc.hashed)
+		}
+	}
+
+	// Salts are truncated to 16 characters
+	if got := shaCrypt(sha256.New, "5", []byte("This is just a test"), []byte("toolongsaltstring"), 5000, true); got != shaCryptVectors[2].hashed {
+		t.Errorf("got %s, want %s", got, shaCryptVectors[2].hashed)
+	}
+
+	// Rounds below the minimum are raised to 1000, which the hash has to state
+	if ok, err := verifySHACrypt("$5$rounds=10$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC", "the minimum number is still observed"); err != nil || ok {
+		t.Errorf("hash with too few rounds: got %v, %v", ok, err)
+	}
+}
+
+// argon2idHash returns a PHC formatted argon2id hash with small parameters
+func argon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestHtpasswdCredentials(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	file := fmt.Sprintf("# users\nalice:%s\n\nbob:%s\ncarol:%s\n", bcryptHash, argon2idHash("argon-pass"), shaCryptVectors[7].hashed)
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h, err := newHtpasswdCredentials(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "bcrypt-pass", true},
+		{"alice", "wrong", false},
+		{"bob", "argon-pass", true},
+		{"bob", "wrong", false},
+		{"carol", "Hello world!", true},
+		{"carol", "wrong", false},
+		{"dave", "bcrypt-pass", false},
+	} {
+		if got := h.Valid(tc.user, tc.password); got != tc.want {
+			t.Errorf("%s/%s: got %v, want %v", tc.user, tc.password, got, tc.want)
+		}
+	}
+
+	// Unknown users are verified against the hash of a known user
+	if h.dummy != string(bcryptHash) && h.dummy != argon2idHash("argon-pass") && h.dummy != shaCryptVectors[7].hashed {
+		t.Errorf("bad dummy hash %q", h.dummy)
+	}
+
+	// Unknown formats are refused
+	for _, entry := range []string{"dave:plain", "dave:$1$salt$hash", "dave:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "no-hash"} {
+		if _, err := parseHtpasswd([]byte(entry)); err == nil {
+			t.Errorf("%s: expected error", entry)
+		}
+	}
+	if _, err := verifyPassword("$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA", "x"); err == nil {
+		t.Errorf("expected unsupported hash error")
+	}
+
+	// Changes of the file are picked up, invalid files are ignored
+	if err := os.WriteFile(path, []byte("dave:"+argon2idHash("new-pass")+"\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := h.reload(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !h.Valid("dave", "new-pass") || h.Valid("alice", "bcrypt-pass") {
+		t.Fatalf("users not reloaded")
+	}
+	if err := os.WriteFile(path, []byte("broken\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := h.reload(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if !h.Valid("dave", "new-pass") {
+		t.Fatalf("previous users not kept")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpAuthRequest is the JSON body posted to the auth service
+type httpAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+// httpAuthResponse is the JSON decision of the auth service,
+// attributes are added to the AuthContext payload
+type httpAuthResponse struct {
+	Allow      bool              `json:"allow"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// httpAuthCredentials is a CredentialStore delegating decisions to an
+// external HTTP auth service. Errors and timeouts deny the login.
+type httpAuthCredentials struct {
+	url    string
+	client *http.Client
+	cache  *authCache
+}
+
+func newHTTPAuthCredentials(url string, timeout time.Duration, cache *authCache) *httpAuthCredentials {
+	return &httpAuthCredentials{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		cache:  cache,
+	}
+}
+
+func (h *httpAuthCredentials) Valid(user, password string) bool {
+	_, ok := h.Verify(user, password, nil)
+	return ok
+}
+
+func (h *httpAuthCredentials) Verify(user, password string, remote net.Addr) (map[string]string, bool) {
+	attributes, ok, _ := h.Check(user, password, remote)
+	return attributes, ok
+}
+
+// Check asks the auth service, errors of the service deny the login
+// without counting as a failure
+func (h *httpAuthCredentials) Check(user, password string, remote net.Addr) (map[string]string, bool, error) {
+	var clientIP string
+	if tcp, ok := remote.(*net.TCPAddr); ok {
+		clientIP = tcp.IP.String()
+	}
+
+	key := authCacheKey(user, password, clientIP)
+	if result, ok := h.cache.get(key); ok {
+		return result.attributes, result.valid, nil
+	}
+
+	decision, err := h.ask(httpAuthRequest{Username: user, Password: password, ClientIP: clientIP})
+	if err != nil {
+		log.Printf("[ERR] httpauth: Failed to authenticate %q, denying: %v", user, err)
+		return nil, false, err
+	}
+	h.cache.put(key, decision.Allow, decision.Attributes)
+	return decision.Attributes, decision.Allow, nil
+}
+
+// ask posts the credentials to the auth service. A 200 response carries the
+// decision, 401 and 403 deny the login, anything else is an error.
+func (h *httpAuthCredentials) ask(req httpAuthRequest) (*httpAuthResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &httpAuthResponse{Allow: false}, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var decision httpAuthResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decision); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return &decision, nil
+}
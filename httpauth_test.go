@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// httpAuthService allows alice with the password secret, answers 500 for
+// broken and does not answer in time for slow
+func httpAuthService(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req httpAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("err: %v", err)
+		}
+		switch req.Username {
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		case "mallory":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		resp := httpAuthResponse{Allow: req.Username == "alice" && req.Password == "secret"}
+		if resp.Allow {
+			resp.Attributes = map[string]string{"Group": "admins", "ClientIP": req.ClientIP}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestHTTPAuthCredentials(t *testing.T) {
+	server, calls := httpAuthService(t)
+	creds := newHTTPAuthCredentials(server.URL, 100*time.Millisecond, newAuthCache(500*time.Millisecond, time.Minute))
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 1234}
+
+	attributes, ok := creds.Verify("alice", "secret", client)
+	if !ok {
+		t.Fatalf("expected alice to be allowed")
+	}
+	if attributes["Group"] != "admins" || attributes["ClientIP"] != "192.0.2.7" {
+		t.Fatalf("bad attributes %v", attributes)
+	}
+
+	for _, tc := range []struct {
+		user, password string
+	}{
+		{"alice", "wrong"},
+		{"mallory", "secret"},
+		{"broken", "secret"},
+		{"slow", "secret"},
+	} {
+		if _, ok := creds.Verify(tc.user, tc.password, client); ok {
+			t.Errorf("%s: expected deny", tc.user)
+		}
+	}
+
+	// Decisions are cached until they expire, failures are not cached
+	before := calls.Load()
+	creds.Verify("alice", "secret", client)
+	creds.Verify("alice", "wrong", client)
+	if calls.Load() != before {
+		t.Fatalf("cached decisions asked the service again")
+	}
+	creds.Verify("broken", "secret", client)
+	if calls.Load() != before+1 {
+		t.Fatalf("failure was cached")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if _, ok := creds.Verify("alice", "secret", client); !ok || calls.Load() != before+2 {
+		t.Fatalf("expired decision was not asked again")
+	}
+}
+
+// authConn is a SOCKS5 client connection in memory
+type authConn struct {
+	bytes.Buffer
+	remote net.Addr
+}
+
+func (c *authConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestHTTPAuthPayload(t *testing.T) {
+	server, _ := httpAuthService(t)
+	cator := socks5.UserPassAuthenticator{Credentials: newHTTPAuthCredentials(server.URL, time.Second, newAuthCache(0, 0))}
+
+	in := bytes.NewBuffer([]byte{1, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	out := &authConn{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 1234}}
+	authContext, err := cator.Authenticate(in, out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if payload := authContext.Payload; payload["Username"] != "alice" || payload["Group"] != "admins" || payload["ClientIP"] != "192.0.2.7" {
+		t.Fatalf("bad payload %v", payload)
+	}
+}
+
+func TestHTTPAuthUnavailable(t *testing.T) {
+	server, _ := httpAuthService(t)
+	creds := newHTTPAuthCredentials(server.URL, 100*time.Millisecond, newAuthCache(0, 0))
+
+	// Rejected credentials count as failed logins, failures of the
+	// service do not
+	for _, tc := range []struct {
+		user, password string
+		unavailable    bool
+	}{
+		{"alice", "wrong", false},
+		{"mallory", "secret", false},
+		{"broken", "secret", true},
+		{"slow", "secret", true},
+	} {
+		_, ok, err := creds.Check(tc.user, tc.password, nil)
+		if ok || (err != nil) != tc.unavailable {
+			t.Errorf("%s: got %v, %v", tc.user, ok, err)
+		}
+	}
+
+	// A chain reports the failure unless another store accepts the user
+	chain := credentialChain{socks5.StaticCredentials{"broken": "static"}, creds}
+	if _, ok, err := chain.Check("broken", "secret", nil); ok || err == nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if _, ok, err := chain.Check("broken", "static", nil); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+
+	// Logins of SOCKS and HTTP proxy clients only count as failures
+	// when the credentials are rejected
+	var failures atomic.Int32
+	proxy := serveUpstream(t, &socks5.Config{
+		Credentials:   creds,
+		OnAuthFailure: func(net.Addr) { failures.Add(1) },
+	})
+	echo := echoServer(t)
+	for _, scheme := range []string{"socks5h", "http"} {
+		for _, tc := range []struct {
+			user, password string
+			failures       int32
+		}{
+			{"broken", "secret", 0},
+			{"alice", "wrong", 1},
+		} {
+			failures.Store(0)
+			up, err := newUpstream(scheme+"://"+tc.user+":"+tc.password+"@"+proxy, time.Second)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if conn, err := up.Dial(context.Background(), "tcp", echo.Addr().String()); err == nil {
+				conn.Close()
+				t.Fatalf("%s %s: expected error", scheme, tc.user)
+			}
+			// The server counts the failure after replying
+			deadline := time.Now().Add(time.Second)
+			for failures.Load() < tc.failures && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := failures.Load(); got != tc.failures {
+				t.Errorf("%s %s: got %d failures, want %d", scheme, tc.user, got, tc.failures)
+			}
+		}
+	}
+}
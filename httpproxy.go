@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// hopHeaders are removed from forwarded requests and responses
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// httpProxy is a HTTP proxy supporting CONNECT tunnels and absolute-URI
+// forwarding, applying the same credentials and rules as the SOCKS server
+type httpProxy struct {
+	config      *socks5.Config
+	credentials socks5.CredentialStore
+	clientCerts *ClientCertAuthenticator
+	isIPAllowed func(net.IP) bool
+	authFailed  func(net.Addr)
+}
+
+// ServeConn is used to serve a single HTTP proxy connection
+func (p *httpProxy) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	bufConn := bufio.NewReader(conn)
+
+	// Check client IP against whitelist
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected client address %v", conn.RemoteAddr())
+	}
+	if !p.isIPAllowed(client.IP) {
+		p.config.Logger.Printf("[WARN] http: Connection from not allowed IP address: %s", client.IP)
+		return fmt.Errorf("connection from not allowed IP address")
+	}
+
+	for {
+		req, err := http.ReadRequest(bufConn)
+		if err != nil {
+			if err != io.EOF {
+				p.config.Logger.Printf("[ERR] http: Failed to read request: %v", err)
+			}
+			return err
+		}
+
+		authContext, ok, err := p.authenticate(conn, req)
+		if !ok {
+			p.config.Logger.Printf("[ERR] http: Failed to authenticate %v", client)
+			// Requests without credentials are the usual first step of the
+			// Basic auth challenge, only wrong credentials count as failures
+			if err == nil && req.Header.Get("Proxy-Authorization") != "" && p.authFailed != nil {
+				p.authFailed(client)
+			}
+			resp := errorResponse(req, http.StatusProxyAuthRequired)
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			return resp.Write(conn)
+		}
+
+		if req.Method == http.MethodConnect {
+			return p.handleConnect(conn, bufConn, req, client, authContext)
+		}
+		if err := p.handleForward(conn, req, client, authContext); err != nil {
+			p.config.Logger.Printf("[ERR] http: %v", err)
+			return err
+		}
+		if req.Close {
+			return nil
+		}
+	}
+}
+
+// authenticate checks the client certificate and the Basic
+// Proxy-Authorization credentials, the error tells that the credential
+// store failed rather than rejected them
+func (p *httpProxy) authenticate(conn net.Conn, req *http.Request) (*socks5.AuthContext, bool, error) {
+	if p.credentials == nil && p.clientCerts == nil {
+		return &socks5.AuthContext{Method: socks5.NoAuth}, true, nil
+	}
+
+	var identity map[string]string
+	if p.clientCerts != nil {
+		var err error
+		identity, err = p.clientCerts.Verify(conn)
+		switch {
+		case err == nil && p.clientCerts.Next == nil:
+			return certContext(identity), true, nil
+		case err != nil && p.clientCerts.Next != nil:
+			return nil, false, nil
+		}
+	}
+	if p.credentials == nil {
+		return nil, false, nil
+	}
+
+	user, password, ok := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return nil, false, nil
+	}
+	attributes, ok, err := socks5.CheckCredentials(p.credentials, user, password, conn.RemoteAddr())
+	if !ok {
+		return nil, false, err
+	}
+	return addIdentity(socks5.UserPassContext(user, attributes), identity), true, nil
+}
+
+// parseBasicAuth is used to decode Basic credentials
+func parseBasicAuth(auth string) (user, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// dial resolves the destination, checks it against the rules and connects to it
+func (p *httpProxy) dial(hostport string, client *net.TCPAddr, authContext *socks5.AuthContext) (net.Conn, int, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if !p.config.CommandEnabled(socks5.ConnectCommand) {
+		return nil, http.StatusForbidden, fmt.Errorf("Connect to %s refused: connect command is disabled", hostport)
+	}
+
+	dest := &socks5.AddrSpec{Port: port}
+	if dest.IP = net.ParseIP(host); dest.IP == nil {
+		dest.FQDN = host
+	}
+	req := &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		AuthContext: authContext,
+		RemoteAddr:  &socks5.AddrSpec{IP: client.IP, Port: client.Port},
+		DestAddr:    dest,
+	}
+
+	// Resolve the address if we have a FQDN, unless the Dial resolves it
+	ctx := socks5.WithRequest(socks5.WithConfig(context.Background(), p.config), req)
+	ctx, err = p.config.ResolveRequest(ctx, req)
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("Failed to resolve destination '%v': %v", dest, err)
+	}
+
+	// Check if this is allowed
+	ctx, ok := p.config.AllowRequest(ctx, req)
+	if !ok {
+		if reason := socks5.RuleReason(ctx); reason != "" {
+			return nil, http.StatusForbidden, fmt.Errorf("Connect to %v blocked by rules: %s", dest, reason)
+		}
+		return nil, http.StatusForbidden, fmt.Errorf("Connect to %v blocked by rules", dest)
+	}
+
+	dial := p.config.Dial
+	if dial == nil {
+		dial = p.config.DirectDial
+	}
+	target, err := p.config.DialAddr(ctx, dial, "tcp", dest)
+	if err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, socks5.ErrRuleFailure):
+			status = http.StatusForbidden
+		case errors.Is(err, socks5.ErrTTLExpired):
+			status = http.StatusGatewayTimeout
+		}
+		return nil, status, fmt.Errorf("Connect to %v failed: %v", dest, err)
+	}
+	return target, http.StatusOK, nil
+}
+
+// handleConnect is used to open a CONNECT tunnel
+func (p *httpProxy) handleConnect(conn net.Conn, bufConn *bufio.Reader, req *http.Request, client *net.TCPAddr, authContext *socks5.AuthContext) error {
+	target, status, err := p.dial(req.Host, client, authContext)
+	if err != nil {
+		p.config.Logger.Printf("[ERR] http: %v", err)
+		errorResponse(req, status).Write(conn)
+		return err
+	}
+	defer target.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return err
+	}
+
+	// Start proxying
+	return socks5.Relay(conn, bufConn, target)
+}
+
+// handleForward is used to forward a single absolute-URI request
+func (p *httpProxy) handleForward(conn net.Conn, req *http.Request, client *net.TCPAddr, authContext *socks5.AuthContext) error {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		errorResponse(req, http.StatusBadRequest).Write(conn)
+		return fmt.Errorf("Unsupported request URI %q", req.RequestURI)
+	}
+
+	hostport := req.URL.Host
+	if req.URL.Port() == "" {
+		hostport = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	target, status, err := p.dial(hostport, client, authContext)
+	if err != nil {
+		errorResponse(req, status).Write(conn)
+		return err
+	}
+	defer target.Close()
+
+	// Send the request in origin form
+	removeHopHeaders(req.Header)
+	req.RequestURI = ""
+	if err := req.Write(target); err != nil {
+		return fmt.Errorf("Failed to forward request to %v: %v", req.URL.Host, err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(target), req)
+	if err != nil {
+		errorResponse(req, http.StatusBadGateway).Write(conn)
+		return fmt.Errorf("Failed to read response from %v: %v", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	// Without a known length the body ends when the connection is closed
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		req.Close = true
+	}
+	resp.Close = req.Close
+	return resp.Write(conn)
+}
+
+// removeHopHeaders removes the headers listed in Connection, then
+// the hop-by-hop headers, RFC 7230 section 6.1
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+// errorResponse builds an empty response with the given status
+func errorResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+		Close:      true,
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/serjs/socks5-server/go-socks5"
+)
+
+// proxyRequest sends the raw request on conn and reads the response,
+// the body is not read for established tunnels
+func proxyRequest(t *testing.T, conn net.Conn, r *bufio.Reader, raw string) (*http.Response, string) {
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	method := strings.Fields(raw)[0]
+	resp, err := http.ReadResponse(r, &http.Request{Method: method})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if method == http.MethodConnect && resp.StatusCode == http.StatusOK {
+		// The tunnel follows
+		return resp, ""
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{"X-Secret", "Proxy-Authorization", "Proxy-Connection"} {
+			if r.Header.Get(h) != "" {
+				t.Errorf("hop header %s forwarded", h)
+			}
+		}
+		w.Header().Set("Connection", "X-Origin-Hop")
+		w.Header().Set("X-Origin-Hop", "1")
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+	echo := echoServer(t)
+
+	proxy := serveUpstream(t, &socks5.Config{Credentials: socks5.StaticCredentials{"foo": "bar"}})
+	strict := serveUpstream(t, &socks5.Config{Rules: socks5.PermitNone()})
+	const auth = "Proxy-Authorization: Basic Zm9vOmJhcg==\r\n"
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Without credentials the client is challenged
+	resp, _ := proxyRequest(t, conn, r, "GET "+origin.URL+"/a HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+"\r\n\r\n")
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != `Basic realm="proxy"` {
+		t.Fatalf("bad challenge %s %v", resp.Status, resp.Header)
+	}
+
+	// Absolute-URI requests are forwarded on a kept alive connection
+	conn, err = net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	for _, path := range []string{"/a", "/b"} {
+		resp, body := proxyRequest(t, conn, r, "GET "+origin.URL+path+" HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+"\r\n"+auth+
+			"Proxy-Connection: keep-alive\r\nConnection: X-Secret\r\nX-Secret: 1\r\n\r\n")
+		if resp.StatusCode != http.StatusOK || body != "hello "+path {
+			t.Fatalf("bad response %s %q", resp.Status, body)
+		}
+		if resp.Header.Get("X-Origin-Hop") != "" || resp.Close {
+			t.Fatalf("bad response headers %v", resp.Header)
+		}
+	}
+
+	// CONNECT tunnels
+	resp, _ = proxyRequest(t, conn, r, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n"+auth+"\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad CONNECT response %s", resp.Status)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("bad echo %q: %v", buf, err)
+	}
+
+	// Blocked destinations
+	for _, raw := range []string{
+		"CONNECT " + echo.Addr().String() + " HTTP/1.1\r\nHost: " + echo.Addr().String() + "\r\n\r\n",
+		"GET " + origin.URL + "/a HTTP/1.1\r\nHost: " + origin.Listener.Addr().String() + "\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", strict)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp, _ := proxyRequest(t, conn, bufio.NewReader(conn), raw)
+		conn.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %s, want 403", strings.Fields(raw)[0], resp.Status)
+		}
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":    {"close, X-Listed", "x-other"},
+		"X-Listed":      {"1"},
+		"X-Other":       {"1"},
+		"Keep-Alive":    {"timeout=5"},
+		"Te":            {"trailers"},
+		"Content-Type":  {"text/plain"},
+		"Cache-Control": {"no-cache"},
+	}
+	removeHopHeaders(header)
+	if len(header) != 2 || header.Get("Content-Type") == "" || header.Get("Cache-Control") == "" {
+		t.Fatalf("bad headers %v", header)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// prefixTrie is a binary trie of IPv4 and IPv6 prefixes, matching an
+// address in at most 32 or 128 steps whatever the number of prefixes
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+// newPrefixTrie parses single IPs and CIDR prefixes into a trie
+func newPrefixTrie(entries []string) (*prefixTrie, error) {
+	t := &prefixTrie{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		t.Insert(prefix)
+	}
+	return t, nil
+}
+
+// parsePrefix parses an IP address or a CIDR prefix, a single
+// address is a full length prefix
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return unmapPrefix(prefix), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// unmapPrefix turns an IPv4-mapped IPv6 prefix like ::ffff:10.0.0.0/104
+// into its IPv4 form
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if !addr.Is4In6() || prefix.Bits() < 96 {
+		return prefix.Masked()
+	}
+	return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked()
+}
+
+// Insert adds the prefix to the trie
+func (t *prefixTrie) Insert(prefix netip.Prefix) {
+	prefix = unmapPrefix(prefix)
+	root := &t.v6
+	if prefix.Addr().Is4() {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+
+	node := *root
+	addr := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.terminal {
+			// A shorter prefix already covers this one
+			return
+		}
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	node.children = [2]*trieNode{}
+}
+
+// Contains reports whether the address is in any of the prefixes
+func (t *prefixTrie) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+
+	b := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		node = node.children[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// ContainsIP is Contains for a net.IP, invalid IPs are never contained
+func (t *prefixTrie) ContainsIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return t.Contains(addr)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	trie, err := newPrefixTrie([]string{"10.0.0.0/8", "192.168.1.7", "2001:db8::/32", "::ffff:172.16.0.0/108", ""})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for ip, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"11.0.0.1":         false,
+		"192.168.1.7":      true,
+		"192.168.1.8":      false,
+		"::ffff:10.9.9.9":  true,
+		"172.16.5.5":       true,
+		"172.32.0.1":       false,
+		"2001:db8:1::1":    true,
+		"2001:db9::1":      false,
+		"::1":              false,
+		"::ffff:11.0.0.1":  false,
+		"2001:db8:ffff::0": true,
+	} {
+		if got := trie.ContainsIP(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: got %v, want %v", ip, got, want)
+		}
+	}
+	if trie.ContainsIP(nil) {
+		t.Errorf("nil IP must not match")
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "10.0.0", "example.com"} {
+		if _, err := newPrefixTrie([]string{bad}); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapCredentials is a CredentialStore doing search-then-bind against an
+// LDAP directory, with an optional group membership requirement.
+// Directory errors deny the login.
+type ldapCredentials struct {
+	url          string
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userFilter   string
+	groupDN      string
+	startTLS     bool
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+
+	pool  chan *ldap.Conn
+	cache *authCache
+}
+
+// newLDAPCredentials builds the LDAP CredentialStore from the app params
+func newLDAPCredentials(cfg params, cache *authCache) (*ldapCredentials, error) {
+	if cfg.LDAPBaseDN == "" {
+		return nil, fmt.Errorf("LDAP_BASE_DN is required for LDAP_URL")
+	}
+	if strings.Count(cfg.LDAPUserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("LDAP_USER_FILTER must contain exactly one %%s for the username")
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.LDAPCAFile != "" {
+		pem, err := os.ReadFile(cfg.LDAPCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in LDAP_CA_FILE %s", cfg.LDAPCAFile)
+		}
+	}
+
+	return &ldapCredentials{
+		url:          cfg.LDAPURL,
+		bindDN:       cfg.LDAPBindDN,
+		bindPassword: cfg.LDAPBindPassword,
+		baseDN:       cfg.LDAPBaseDN,
+		userFilter:   cfg.LDAPUserFilter,
+		groupDN:      cfg.LDAPGroupDN,
+		startTLS:     cfg.LDAPStartTLS,
+		tlsConfig:    tlsConfig,
+		timeout:      cfg.LDAPTimeout,
+		pool:         make(chan *ldap.Conn, max(cfg.LDAPPoolSize, 1)),
+		cache:        cache,
+	}, nil
+}
+
+func (l *ldapCredentials) Valid(user, password string) bool {
+	_, ok := l.Verify(user, password, nil)
+	return ok
+}
+
+func (l *ldapCredentials) Verify(user, password string, remote net.Addr) (map[string]string, bool) {
+	attributes, ok, _ := l.Check(user, password, remote)
+	return attributes, ok
+}
+
+// Check binds as the user, errors of the directory deny the login
+// without counting as a failure
+func (l *ldapCredentials) Check(user, password string, remote net.Addr) (map[string]string, bool, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if user == "" || password == "" {
+		return nil, false, nil
+	}
+
+	key := authCacheKey(user, password)
+	if result, ok := l.cache.get(key); ok {
+		return result.attributes, result.valid, nil
+	}
+
+	dn, err := l.authenticate(user, password)
+	if err != nil {
+		log.Printf("[ERR] ldap: Failed to authenticate %q, denying: %v", user, err)
+		return nil, false, err
+	}
+	if dn == "" {
+		l.cache.put(key, false, nil)
+		return nil, false, nil
+	}
+
+	attributes := map[string]string{"LDAPDN": dn}
+	l.cache.put(key, true, attributes)
+	return attributes, true, nil
+}
+
+// authenticate returns the DN of the user when the password and group
+// membership are valid, and an empty DN when they are not
+func (l *ldapCredentials) authenticate(user, password string) (string, error) {
+	conn, err := l.get()
+	if err != nil {
+		return "", err
+	}
+
+	dn, err := l.findUser(conn, user)
+	if err != nil || dn == "" {
+		l.put(conn, err)
+		return "", err
+	}
+
+	// Bind as the user, then restore the service bind for the next search
+	err = conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		l.put(conn, l.bind(conn))
+		return "", nil
+	}
+	if err != nil {
+		l.put(conn, err)
+		return "", err
+	}
+	l.put(conn, l.bind(conn))
+	return dn, nil
+}
+
+// findUser searches the user DN, checking the group membership if required
+func (l *ldapCredentials) findUser(conn *ldap.Conn, user string) (string, error) {
+	filter := fmt.Sprintf(l.userFilter, ldap.EscapeFilter(user))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.timeout.Seconds()), false,
+		filter, []string{"memberOf"}, nil,
+	))
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) != 1 {
+		return "", nil
+	}
+
+	entry := result.Entries[0]
+	if l.groupDN == "" {
+		return entry.DN, nil
+	}
+	for _, group := range entry.GetAttributeValues("memberOf") {
+		if strings.EqualFold(group, l.groupDN) {
+			return entry.DN, nil
+		}
+	}
+
+	// Directories without memberOf list the members on the group entry
+	escaped := ldap.EscapeFilter(entry.DN)
+	result, err = conn.Search(ldap.NewSearchRequest(
+		l.groupDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(l.timeout.Seconds()), false,
+		fmt.Sprintf("(|(member=%s)(uniqueMember=%s))", escaped, escaped), []string{"dn"}, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) == 0 {
+		return "", nil
+	}
+	return entry.DN, nil
+}
+
+// get returns a pooled connection bound as the service account,
+// or dials a new one
+func (l *ldapCredentials) get() (*ldap.Conn, error) {
+	for {
+		select {
+		case conn := <-l.pool:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return l.dial()
+		}
+	}
+}
+
+// put returns a connection to the pool, broken or surplus connections are closed
+func (l *ldapCredentials) put(conn *ldap.Conn, err error) {
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case l.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (l *ldapCredentials) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: l.timeout}),
+		ldap.DialWithTLSConfig(l.tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(l.timeout)
+
+	if l.startTLS {
+		tlsConfig := l.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			if u, err := url.Parse(l.url); err == nil {
+				tlsConfig.ServerName = u.Hostname()
+			}
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := l.bind(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bind authenticates the connection as the service account,
+// or anonymously without LDAP_BIND_DN
+func (l *ldapCredentials) bind(conn *ldap.Conn) error {
+	if l.bindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(l.bindDN, l.bindPassword)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapEntry is a user of the stub directory
+type ldapEntry struct {
+	dn       string
+	password string
+	memberOf []string
+}
+
+// ldapStub is a minimal LDAP server answering simple binds and the
+// equality filter searches of the users and groups
+type ldapStub struct {
+	users  map[string]ldapEntry
+	groups map[string][]string
+
+	mu      sync.Mutex
+	filters []string
+}
+
+func serveLDAP(t *testing.T, stub *ldapStub) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func (s *ldapStub) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := ber.DecodeString(op.Children[1].Data.Bytes())
+			password := ber.DecodeString(op.Children[2].Data.Bytes())
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if dn == "" || dn == "cn=proxy,dc=test" && password == "service" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, user := range s.users {
+				if user.dn == dn && user.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			base := ber.DecodeString(op.Children[0].Data.Bytes())
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			s.mu.Lock()
+			s.filters = append(s.filters, filter)
+			s.mu.Unlock()
+
+			code := int64(ldap.LDAPResultSuccess)
+			if members, ok := s.groups[base]; ok {
+				for _, member := range members {
+					if strings.Contains(filter, "(member="+ldap.EscapeFilter(member)+")") {
+						conn.Write(ldapEntryPacket(id, base, nil).Bytes())
+					}
+				}
+			} else if base == "dc=test" {
+				for name, user := range s.users {
+					if filter == "(uid="+ldap.EscapeFilter(name)+")" {
+						conn.Write(ldapEntryPacket(id, user.dn, user.memberOf).Bytes())
+					}
+				}
+			} else {
+				code = ldap.LDAPResultNoSuchObject
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, code).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// lastFilter returns the filter of the last search
+func (s *ldapStub) lastFilter() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.filters) == 0 {
+		return ""
+	}
+	return s.filters[len(s.filters)-1]
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	msg.AppendChild(op)
+	return msg
+}
+
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, op)
+}
+
+func ldapEntryPacket(id int64, dn string, memberOf []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	if len(memberOf) > 0 {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, group := range memberOf {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, ""))
+		}
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return ldapMessage(id, op)
+}
+
+func TestLDAPCredentials(t *testing.T) {
+	const group = "cn=socks,ou=groups,dc=test"
+	stub := &ldapStub{
+		users: map[string]ldapEntry{
+			// alice is a member by memberOf, bob on the group entry
+			"alice":     {dn: "uid=alice,ou=people,dc=test", password: "secret", memberOf: []string{group}},
+			"bob":       {dn: "uid=bob,ou=people,dc=test", password: "secret"},
+			"carol":     {dn: "uid=carol,ou=people,dc=test", password: "secret"},
+			"al*(x)\\y": {dn: "uid=odd,ou=people,dc=test", password: "secret"},
+		},
+		groups: map[string][]string{group: {"uid=bob,ou=people,dc=test"}},
+	}
+	url := serveLDAP(t, stub)
+
+	newCreds := func(groupDN string) *ldapCredentials {
+		creds, err := newLDAPCredentials(params{
+			LDAPURL:          url,
+			LDAPBindDN:       "cn=proxy,dc=test",
+			LDAPBindPassword: "service",
+			LDAPBaseDN:       "dc=test",
+			LDAPUserFilter:   "(uid=%s)",
+			LDAPGroupDN:      groupDN,
+			LDAPTimeout:      time.Second,
+			LDAPPoolSize:     2,
+		}, newAuthCache(0, 0))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return creds
+	}
+
+	for _, tc := range []struct {
+		groupDN  string
+		user     string
+		password string
+		want     bool
+	}{
+		{"", "alice", "secret", true},
+		{"", "carol", "secret", true},
+		{"", "alice", "wrong", false},
+		{"", "dave", "secret", false},
+		{"", "alice", "", false},
+		{group, "alice", "secret", true},
+		{group, "bob", "secret", true},
+		{group, "carol", "secret", false},
+	} {
+		attributes, ok := newCreds(tc.groupDN).Verify(tc.user, tc.password, nil)
+		if ok != tc.want {
+			t.Errorf("%s in %q: got %v, want %v", tc.user, tc.groupDN, ok, tc.want)
+		}
+		if ok && attributes["LDAPDN"] != stub.users[tc.user].dn {
+			t.Errorf("%s: bad attributes %v", tc.user, attributes)
+		}
+	}
+
+	// Filter characters of the username are escaped, a wildcard
+	// does not match other users
+	creds := newCreds("")
+	if _, ok := creds.Verify("*", "secret", nil); ok {
+		t.Fatalf("wildcard username logged in")
+	}
+	if filter := stub.lastFilter(); filter != `(uid=\2a)` {
+		t.Fatalf("bad filter %s", filter)
+	}
+	if _, ok := creds.Verify("al*(x)\\y", "secret", nil); !ok {
+		t.Fatalf("username with filter characters not found")
+	}
+	if filter := stub.lastFilter(); filter != `(uid=al\2a\28x\29\5cy)` {
+		t.Fatalf("bad filter %s", filter)
+	}
+}
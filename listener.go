@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+)
+
+// sniffTimeout limits how long a new connection may take to send its first byte
+const sniffTimeout = 30 * time.Second
+
+// protocolMux serves SOCKS and HTTP proxy clients on the same listener.
+// HTTP clients are refused when http is nil.
+type protocolMux struct {
+	socks       *socks5.Server
+	http        *httpProxy
+	isIPAllowed func(net.IP) bool
+	logger      *log.Logger
+}
+
+// Serve is used to serve connections from a listener
+func (m *protocolMux) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go m.serveConn(conn)
+	}
+}
+
+// serveConn routes the connection by its first byte: SOCKS versions go to
+// the SOCKS server and ASCII methods to the HTTP proxy
+func (m *protocolMux) serveConn(conn net.Conn) {
+	// Refuse denied and banned clients before reading anything
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !m.isIPAllowed(client.IP) {
+		m.logger.Printf("[WARN] mux: Connection from not allowed IP address: %s", client.IP)
+		conn.Close()
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	first, err := r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	buffered := &bufferedConn{Conn: conn, r: r}
+	switch b := first[0]; {
+	case b == 4 || b == 5:
+		m.socks.ServeConn(buffered)
+	case b >= 'A' && b <= 'Z' && m.http != nil:
+		m.http.ServeConn(buffered)
+	default:
+		m.logger.Printf("[ERR] mux: Unknown protocol from %v, first byte %#x", conn.RemoteAddr(), b)
+		conn.Close()
+	}
+}
+
+// bufferedConn is a net.Conn which reads through the buffer
+// used to sniff the protocol
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite lets the proxies half-close the client connection
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ConnectionState exposes the TLS state to client certificate authentication
+func (c *bufferedConn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// Upstream pool balancing strategies
+const (
+	strategyRoundRobin = "round-robin"
+	strategyLeastConn  = "least-conn"
+	strategyHashUser   = "hash-user"
+)
+
+// poolMember is an upstream of the pool with its health state
+type poolMember struct {
+	up     *upstream
+	active atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+}
+
+// available reports whether the member passes its health checks
+// and is not ejected after dial errors
+func (m *poolMember) available(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.healthy && now.After(m.ejectedUntil)
+}
+
+// upstreamPool spreads connections over several upstream proxies. Members
+// failing active health checks, or maxFailures dials in a row, are skipped
+// until they recover, and failed dials are retried on other members.
+type upstreamPool struct {
+	members     []*poolMember
+	strategy    string
+	retries     int
+	maxFailures int
+	ejectTime   time.Duration
+
+	next atomic.Uint32
+}
+
+// newUpstreamPool builds the pool from the app params and starts
+// the health checks
+func newUpstreamPool(cfg params) (*upstreamPool, error) {
+	switch cfg.UpstreamStrategy {
+	case strategyRoundRobin, strategyLeastConn, strategyHashUser:
+	default:
+		return nil, fmt.Errorf("unknown UPSTREAM_STRATEGY %q", cfg.UpstreamStrategy)
+	}
+
+	p := &upstreamPool{
+		strategy:    cfg.UpstreamStrategy,
+		retries:     max(cfg.UpstreamRetries, 0),
+		maxFailures: cfg.UpstreamMaxFailures,
+		ejectTime:   cfg.UpstreamEjectTime,
+	}
+	for _, rawURL := range cfg.UpstreamProxy {
+		if rawURL == "" {
+			continue
+		}
+		up, err := newUpstream(rawURL, cfg.UpstreamTimeout)
+		if err != nil {
+			return nil, err
+		}
+		p.members = append(p.members, &poolMember{up: up, healthy: true})
+	}
+	if len(p.members) == 0 {
+		return nil, fmt.Errorf("UPSTREAM_PROXY contains no upstreams")
+	}
+
+	if cfg.UpstreamHealthInterval > 0 && len(p.members) > 1 {
+		go p.healthChecks(cfg.UpstreamHealthInterval)
+	}
+	return p, nil
+}
+
+// String lists the pool members without their passwords
+func (p *upstreamPool) String() string {
+	s := ""
+	for i, m := range p.members {
+		if i > 0 {
+			s += ", "
+		}
+		s += m.up.String()
+	}
+	return s
+}
+
+// Dial connects through the members in the order of the strategy,
+// retrying upstream failures on the next member. Errors of the
+// destination itself are returned without retry.
+func (p *upstreamPool) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	order := p.order(ctx)
+	var lastErr error
+	for i, m := range order[:min(len(order), p.retries+1)] {
+		m.active.Add(1)
+		conn, err := m.up.Dial(ctx, network, addr)
+		if err == nil {
+			m.succeeded()
+			return &poolConn{Conn: conn, member: m}, nil
+		}
+		m.active.Add(-1)
+		if !errors.Is(err, socks5.ErrServerFailure) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		m.failed(p.maxFailures, p.ejectTime)
+		lastErr = err
+		if i+1 < len(order) && i < p.retries {
+			log.Printf("[WARN] upstream: Retrying %s on another upstream: %v", addr, err)
+		}
+	}
+	return nil, lastErr
+}
+
+// order returns the available members in the order they are tried,
+// or all members when none is available
+func (p *upstreamPool) order(ctx context.Context) []*poolMember {
+	now := time.Now()
+	var members []*poolMember
+	for _, m := range p.members {
+		if m.available(now) {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		members = append(members, p.members...)
+	}
+
+	// Rotate for round robin, and to break least-conn ties
+	start := int(p.next.Add(1)-1) % len(members)
+	members = append(members[start:], members[:start]...)
+
+	switch p.strategy {
+	case strategyLeastConn:
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].active.Load() < members[j].active.Load()
+		})
+	case strategyHashUser:
+		// Rendezvous hashing keeps the users of a member in place when
+		// other members come and go
+		key := hashKey(ctx)
+		scores := make(map[*poolMember]uint64, len(members))
+		for _, m := range members {
+			sum := sha256.Sum256([]byte(key + "\x00" + m.up.addr))
+			scores[m] = binary.BigEndian.Uint64(sum[:8])
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return scores[members[i]] > scores[members[j]]
+		})
+	}
+	return members
+}
+
+// hashKey returns the username of the request, or the client IP
+// for unauthenticated requests
+func hashKey(ctx context.Context) string {
+	req, ok := socks5.RequestFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if req.AuthContext != nil {
+		if user := req.AuthContext.Payload["Username"]; user != "" {
+			return user
+		}
+	}
+	if req.RemoteAddr != nil {
+		return req.RemoteAddr.IP.String()
+	}
+	return ""
+}
+
+func (m *poolMember) succeeded() {
+	m.mu.Lock()
+	m.failures = 0
+	m.mu.Unlock()
+}
+
+// failed counts a dial error, ejecting the member after maxFailures in a row
+func (m *poolMember) failed(maxFailures int, ejectTime time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures++
+	if maxFailures > 0 && m.failures >= maxFailures {
+		m.failures = 0
+		m.ejectedUntil = time.Now().Add(ejectTime)
+		log.Printf("[WARN] upstream: Ejected %s for %v after %d failed dials", m.up, ejectTime, maxFailures)
+	}
+}
+
+// healthChecks checks every member at each interval
+func (p *upstreamPool) healthChecks(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, m := range p.members {
+			err := m.up.check()
+			m.mu.Lock()
+			if err != nil && m.healthy {
+				log.Printf("[WARN] upstream: %s is down: %v", m.up, err)
+			} else if err == nil && !m.healthy {
+				log.Printf("[INFO] upstream: %s is up", m.up)
+			}
+			m.healthy = err == nil
+			m.mu.Unlock()
+		}
+	}
+}
+
+// check connects to the upstream and, for SOCKS5, runs the
+// method negotiation of the handshake
+func (u *upstream) check() error {
+	conn, err := net.DialTimeout("tcp", u.addr, u.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(u.timeout))
+
+	if u.tls != nil {
+		tlsConn := tls.Client(conn, u.tls)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+	if u.url.Scheme != "socks5" && u.url.Scheme != "socks5h" {
+		return nil
+	}
+
+	method := byte(socksNoAuth)
+	if u.user != "" {
+		method = socksUserPassAuth
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return fmt.Errorf("unexpected handshake reply %v", reply)
+	}
+	return nil
+}
+
+// poolConn releases its member's active connection on close
+type poolConn struct {
+	net.Conn
+	member *poolMember
+	once   sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.member.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// CloseWrite lets the proxies half-close the upstream connection
+func (c *poolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+func TestUpstreamPool(t *testing.T) {
+	echo := echoServer(t)
+	first := serveUpstream(t, &socks5.Config{})
+	second := serveUpstream(t, &socks5.Config{})
+
+	// A closed port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	closed.Close()
+
+	cfg := params{
+		UpstreamProxy:       []string{"socks5://" + closed.Addr().String(), "socks5://" + first, "http://" + second},
+		UpstreamTimeout:     time.Second,
+		UpstreamStrategy:    strategyRoundRobin,
+		UpstreamMaxFailures: 2,
+		UpstreamEjectTime:   time.Minute,
+		UpstreamRetries:     2,
+	}
+	pool, err := newUpstreamPool(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Dials retry past the closed upstream until it is ejected
+	for i := 0; i < 6; i++ {
+		conn, err := pool.Dial(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("dial %d: err: %v", i, err)
+		}
+		conn.Close()
+	}
+	if pool.members[0].available(time.Now()) {
+		t.Fatalf("closed upstream not ejected")
+	}
+	for _, m := range pool.members {
+		if n := m.active.Load(); n != 0 {
+			t.Errorf("%s: %d active connections after close", m.up, n)
+		}
+	}
+	if err := pool.members[0].up.check(); err == nil {
+		t.Errorf("health check of closed upstream passed")
+	}
+	if err := pool.members[1].up.check(); err != nil {
+		t.Errorf("health check: err: %v", err)
+	}
+
+	// Destination errors are not retried
+	if _, err := pool.Dial(context.Background(), "tcp", closed.Addr().String()); !errors.Is(err, socks5.ErrConnectionRefused) && !errors.Is(err, socks5.ErrHostUnreachable) {
+		t.Errorf("got %v, want a destination error", err)
+	}
+
+	// Hashing keeps a user on the same upstream
+	cfg.UpstreamStrategy = strategyHashUser
+	pool, err = newUpstreamPool(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx := socks5.WithRequest(context.Background(), &socks5.Request{
+		AuthContext: &socks5.AuthContext{Payload: map[string]string{"Username": "alice"}},
+	})
+	want := pool.order(ctx)[0]
+	for i := 0; i < 5; i++ {
+		if got := pool.order(ctx)[0]; got != want {
+			t.Fatalf("user moved from %s to %s", want.up, got.up)
+		}
+	}
+
+	cfg.UpstreamStrategy = "random"
+	if _, err := newUpstreamPool(cfg); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RADIUS packet codes and attribute types, RFC 2865 and RFC 3579
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusFilterID             = 11
+	radiusReplyMessage         = 18
+	radiusClass                = 25
+	radiusSessionTimeout       = 27
+	radiusIdleTimeout          = 28
+	radiusCallingStationID     = 31
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+
+	radiusHeaderLen   = 20
+	radiusMaxPacket   = 4096
+	radiusMaxPassword = 128
+	radiusDefaultPort = "1812"
+)
+
+var errRadiusTimeout = errors.New("no response from any RADIUS server")
+
+// radiusPayloadKeys maps reply attributes to their AuthContext payload keys
+var radiusPayloadKeys = map[byte]string{
+	radiusFilterID:       "RADIUSFilterId",
+	radiusReplyMessage:   "RADIUSReplyMessage",
+	radiusClass:          "RADIUSClass",
+	radiusSessionTimeout: "RADIUSSessionTimeout",
+	radiusIdleTimeout:    "RADIUSIdleTimeout",
+}
+
+// radiusCredentials is a CredentialStore sending PAP Access-Requests to
+// RADIUS servers. Requests are retransmitted on timeout and fail over to
+// the next server, the last responding server is tried first.
+type radiusCredentials struct {
+	servers       []string
+	secret        []byte
+	timeout       time.Duration
+	retries       int
+	nasIdentifier string
+	// requireMessageAuth refuses replies without a Message-Authenticator
+	requireMessageAuth bool
+	cache              *authCache
+
+	preferred atomic.Int32
+}
+
+// newRADIUSCredentials builds the RADIUS CredentialStore from the app params
+func newRADIUSCredentials(cfg params, cache *authCache) (*radiusCredentials, error) {
+	if cfg.RADIUSSecret == "" {
+		return nil, fmt.Errorf("RADIUS_SECRET is required for RADIUS_SERVERS")
+	}
+
+	var servers []string
+	for _, server := range cfg.RADIUSServers {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, radiusDefaultPort)
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("RADIUS_SERVERS contains no servers")
+	}
+
+	return &radiusCredentials{
+		servers:            servers,
+		secret:             []byte(cfg.RADIUSSecret),
+		timeout:            cfg.RADIUSTimeout,
+		retries:            max(cfg.RADIUSRetries, 0),
+		nasIdentifier:      cfg.RADIUSNASIdentifier,
+		requireMessageAuth: cfg.RADIUSRequireMessageAuth,
+		cache:              cache,
+	}, nil
+}
+
+func (r *radiusCredentials) Valid(user, password string) bool {
+	_, ok := r.Verify(user, password, nil)
+	return ok
+}
+
+func (r *radiusCredentials) Verify(user, password string, remote net.Addr) (map[string]string, bool) {
+	attributes, ok, _ := r.Check(user, password, remote)
+	return attributes, ok
+}
+
+// Check sends the Access-Request, servers not answering deny the login
+// without counting as a failure
+func (r *radiusCredentials) Check(user, password string, remote net.Addr) (map[string]string, bool, error) {
+	if user == "" || len(password) > radiusMaxPassword {
+		return nil, false, nil
+	}
+	var clientIP string
+	if tcp, ok := remote.(*net.TCPAddr); ok {
+		clientIP = tcp.IP.String()
+	}
+
+	key := authCacheKey(user, password, clientIP)
+	if result, ok := r.cache.get(key); ok {
+		return result.attributes, result.valid, nil
+	}
+
+	valid, attributes, err := r.authenticate(user, password, clientIP)
+	if err != nil {
+		log.Printf("[ERR] radius: Failed to authenticate %q, denying: %v", user, err)
+		return nil, false, err
+	}
+	r.cache.put(key, valid, attributes)
+	return attributes, valid, nil
+}
+
+// authenticate sends the Access-Request to the servers in turn until one
+// of them answers
+func (r *radiusCredentials) authenticate(user, password, clientIP string) (bool, map[string]string, error) {
+	packet, authenticator, err := r.accessRequest(user, password, clientIP)
+	if err != nil {
+		return false, nil, err
+	}
+
+	first := int(r.preferred.Load())
+	for i := range r.servers {
+		n := (first + i) % len(r.servers)
+		reply, err := r.exchange(r.servers[n], packet, authenticator)
+		if err != nil {
+			log.Printf("[ERR] radius: %s: %v", r.servers[n], err)
+			continue
+		}
+		r.preferred.Store(int32(n))
+
+		switch reply[0] {
+		case radiusAccessAccept:
+			return true, radiusAttributes(reply), nil
+		case radiusAccessReject, radiusAccessChallenge:
+			// Challenges need an interactive client, which SOCKS has not
+			return false, nil, nil
+		}
+		return false, nil, fmt.Errorf("unexpected RADIUS code %d", reply[0])
+	}
+	return false, nil, errRadiusTimeout
+}
+
+// exchange sends the packet to one server, retransmitting it unchanged
+// on timeout, and returns the first valid response
+func (r *radiusCredentials) exchange(server string, packet, authenticator []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, radiusMaxPacket)
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(r.timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			// Ignore stray or forged packets until the deadline
+			if reply := buf[:n]; r.validReply(reply, packet[1], authenticator) {
+				return append([]byte(nil), reply...), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no response after %d attempts", r.retries+1)
+}
+
+// accessRequest builds an Access-Request packet, it returns the packet
+// and its Request Authenticator
+func (r *radiusCredentials) accessRequest(user, password, clientIP string) ([]byte, []byte, error) {
+	header := make([]byte, radiusHeaderLen)
+	header[0] = radiusAccessRequest
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, nil, err
+	}
+	authenticator := header[4:radiusHeaderLen]
+
+	packet := bytes.NewBuffer(header)
+	if err := writeRadiusAttribute(packet, radiusUserName, []byte(user)); err != nil {
+		return nil, nil, err
+	}
+	writeRadiusAttribute(packet, radiusUserPassword, radiusHidePassword([]byte(password), r.secret, authenticator))
+	if r.nasIdentifier != "" {
+		writeRadiusAttribute(packet, radiusNASIdentifier, []byte(r.nasIdentifier))
+	}
+	if clientIP != "" {
+		writeRadiusAttribute(packet, radiusCallingStationID, []byte(clientIP))
+	}
+
+	// Message-Authenticator protects the request against forgery
+	// (BlastRADIUS), it is computed with its own value zeroed
+	offset := packet.Len() + 2
+	writeRadiusAttribute(packet, radiusMessageAuthenticator, make([]byte, md5.Size))
+	raw := packet.Bytes()
+	binary.BigEndian.PutUint16(raw[2:4], uint16(len(raw)))
+	mac := hmac.New(md5.New, r.secret)
+	mac.Write(raw)
+	copy(raw[offset:], mac.Sum(nil))
+
+	return raw, authenticator, nil
+}
+
+// validReply checks the identifier, length, Response Authenticator and
+// Message-Authenticator of a reply. Without requireMessageAuth, replies of
+// servers not sending a Message-Authenticator are accepted, which leaves
+// them open to forgery (BlastRADIUS).
+func (r *radiusCredentials) validReply(reply []byte, id byte, authenticator []byte) bool {
+	if len(reply) < radiusHeaderLen || reply[1] != id {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(reply[2:4]))
+	if length < radiusHeaderLen || length > len(reply) {
+		return false
+	}
+	reply = reply[:length]
+
+	// MD5(Code+ID+Length+RequestAuth+Attributes+Secret)
+	h := md5.New()
+	h.Write(reply[:4])
+	h.Write(authenticator)
+	h.Write(reply[radiusHeaderLen:])
+	h.Write(r.secret)
+	if !hmac.Equal(h.Sum(nil), reply[4:radiusHeaderLen]) {
+		return false
+	}
+
+	found := false
+	valid := true
+	walkRadiusAttributes(reply, func(typ byte, value []byte, offset int) {
+		if typ != radiusMessageAuthenticator || len(value) != md5.Size {
+			return
+		}
+		found = true
+		check := append([]byte(nil), reply...)
+		copy(check[4:radiusHeaderLen], authenticator)
+		copy(check[offset+2:], make([]byte, md5.Size))
+		mac := hmac.New(md5.New, r.secret)
+		mac.Write(check)
+		valid = valid && hmac.Equal(mac.Sum(nil), value)
+	})
+	if !found {
+		return !r.requireMessageAuth
+	}
+	return valid
+}
+
+// radiusAttributes maps the known reply attributes to payload values,
+// repeated attributes are joined with commas
+func radiusAttributes(reply []byte) map[string]string {
+	attributes := make(map[string]string)
+	walkRadiusAttributes(reply, func(typ byte, value []byte, _ int) {
+		key, ok := radiusPayloadKeys[typ]
+		if !ok {
+			return
+		}
+		var s string
+		switch typ {
+		case radiusSessionTimeout, radiusIdleTimeout:
+			if len(value) != 4 {
+				return
+			}
+			s = strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10)
+		case radiusClass:
+			s = hex.EncodeToString(value)
+		default:
+			s = string(value)
+		}
+		if prev, ok := attributes[key]; ok {
+			s = prev + "," + s
+		}
+		attributes[key] = s
+	})
+	return attributes
+}
+
+// walkRadiusAttributes calls fn for every attribute of the packet with its
+// type, value and offset, stopping at the first malformed attribute
+func walkRadiusAttributes(packet []byte, fn func(typ byte, value []byte, offset int)) {
+	length := min(int(binary.BigEndian.Uint16(packet[2:4])), len(packet))
+	for offset := radiusHeaderLen; offset+2 <= length; {
+		l := int(packet[offset+1])
+		if l < 2 || offset+l > length {
+			return
+		}
+		fn(packet[offset], packet[offset+2:offset+l], offset)
+		offset += l
+	}
+}
+
+func writeRadiusAttribute(b *bytes.Buffer, typ byte, value []byte) error {
+	if len(value) > 253 {
+		return fmt.Errorf("RADIUS attribute %d exceeds 253 bytes", typ)
+	}
+	b.WriteByte(typ)
+	b.WriteByte(byte(len(value) + 2))
+	b.Write(value)
+	return nil
+}
+
+// radiusHidePassword encrypts the User-Password as described in
+// RFC 2865 section 5.2
+func radiusHidePassword(password, secret, authenticator []byte) []byte {
+	padded := make([]byte, max((len(password)+15)/16*16, 16))
+	copy(padded, password)
+
+	last := authenticator
+	for i := 0; i < len(padded); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(last)
+		b := h.Sum(nil)
+		for j := range b {
+			padded[i+j] ^= b[j]
+		}
+		last = padded[i : i+16]
+	}
+	return padded
+}
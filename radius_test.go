@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// radiusResponder is a minimal RADIUS server accepting a single user,
+// signing its replies with a Message-Authenticator when signed is set
+func radiusResponder(t *testing.T, secret, user, password string, signed bool) *net.UDPConn {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		buf := make([]byte, radiusMaxPacket)
+		for {
+			n, from, err := l.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			authenticator := req[4:radiusHeaderLen]
+
+			var gotUser, gotPassword []byte
+			var gotMAC []byte
+			walkRadiusAttributes(req, func(typ byte, value []byte, offset int) {
+				switch typ {
+				case radiusUserName:
+					gotUser = value
+				case radiusUserPassword:
+					gotPassword = radiusRevealPassword(value, []byte(secret), authenticator)
+				case radiusMessageAuthenticator:
+					gotMAC = append([]byte(nil), value...)
+					copy(req[offset+2:], make([]byte, md5.Size))
+				}
+			})
+			mac := hmac.New(md5.New, []byte(secret))
+			mac.Write(req)
+			if !hmac.Equal(mac.Sum(nil), gotMAC) {
+				t.Errorf("bad Message-Authenticator")
+				return
+			}
+
+			reply := bytes.NewBuffer([]byte{radiusAccessReject, req[1], 0, 0})
+			reply.Write(authenticator)
+			if signed {
+				writeRadiusAttribute(reply, radiusMessageAuthenticator, make([]byte, md5.Size))
+			}
+			if string(gotUser) == user && string(gotPassword) == password {
+				reply.Bytes()[0] = radiusAccessAccept
+				writeRadiusAttribute(reply, radiusFilterID, []byte("premium"))
+				writeRadiusAttribute(reply, radiusSessionTimeout, []byte{0, 0, 0x0e, 0x10})
+			}
+			raw := reply.Bytes()
+			binary.BigEndian.PutUint16(raw[2:4], uint16(len(raw)))
+			if signed {
+				// Computed with the Request Authenticator in the header
+				mac := hmac.New(md5.New, []byte(secret))
+				mac.Write(raw)
+				copy(raw[radiusHeaderLen+2:], mac.Sum(nil))
+			}
+			h := md5.New()
+			h.Write(raw)
+			h.Write([]byte(secret))
+			copy(raw[4:radiusHeaderLen], h.Sum(nil))
+			l.WriteToUDP(raw, from)
+		}
+	}()
+	return l
+}
+
+// radiusRevealPassword decrypts a User-Password attribute
+func radiusRevealPassword(hidden, secret, authenticator []byte) []byte {
+	password := make([]byte, len(hidden))
+	last := authenticator
+	for i := 0; i+16 <= len(hidden); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(last)
+		b := h.Sum(nil)
+		for j := range b {
+			password[i+j] = hidden[i+j] ^ b[j]
+		}
+		last = hidden[i : i+16]
+	}
+	return bytes.TrimRight(password, "\x00")
+}
+
+func TestRADIUSCredentials(t *testing.T) {
+	// The first server never answers, requests fail over to the second
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer silent.Close()
+	responder := radiusResponder(t, "s3cret", "foo", "a long password over sixteen bytes", true)
+
+	creds, err := newRADIUSCredentials(params{
+		RADIUSServers:            []string{silent.LocalAddr().String(), responder.LocalAddr().String()},
+		RADIUSSecret:             "s3cret",
+		RADIUSTimeout:            50 * time.Millisecond,
+		RADIUSRetries:            1,
+		RADIUSRequireMessageAuth: true,
+	}, newAuthCache(0, 0))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	attributes, ok := creds.Verify("foo", "a long password over sixteen bytes", remote)
+	if !ok {
+		t.Fatalf("expected accept")
+	}
+	if attributes["RADIUSFilterId"] != "premium" || attributes["RADIUSSessionTimeout"] != "3600" {
+		t.Fatalf("bad attributes: %v", attributes)
+	}
+	if _, ok := creds.Verify("foo", "wrong", remote); ok {
+		t.Fatalf("expected reject")
+	}
+
+	// All servers down denies the login
+	responder.Close()
+	if creds.Valid("foo", "a long password over sixteen bytes") {
+		t.Fatalf("expected deny without servers")
+	}
+}
+
+func TestRADIUSMessageAuthenticator(t *testing.T) {
+	// Replies without a Message-Authenticator are refused unless allowed
+	unsigned := radiusResponder(t, "s3cret", "foo", "bar", false)
+	for _, require := range []bool{true, false} {
+		creds, err := newRADIUSCredentials(params{
+			RADIUSServers:            []string{unsigned.LocalAddr().String()},
+			RADIUSSecret:             "s3cret",
+			RADIUSTimeout:            50 * time.Millisecond,
+			RADIUSRequireMessageAuth: require,
+		}, newAuthCache(0, 0))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ok := creds.Valid("foo", "bar"); ok == require {
+			t.Errorf("require %v: got %v", require, ok)
+		}
+	}
+
+	// Signed replies are accepted without the requirement too
+	signed := radiusResponder(t, "s3cret", "foo", "bar", true)
+	creds, err := newRADIUSCredentials(params{
+		RADIUSServers: []string{signed.LocalAddr().String()},
+		RADIUSSecret:  "s3cret",
+		RADIUSTimeout: 50 * time.Millisecond,
+	}, newAuthCache(0, 0))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !creds.Valid("foo", "bar") {
+		t.Fatalf("expected accept")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// dialFunc is the signature of socks5.Config.Dial
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// routesFile is the YAML or JSON format of the routes file
+type routesFile struct {
+	// Upstreams names the upstream proxy URLs used by the routes
+	Upstreams map[string]string `yaml:"upstreams" json:"upstreams"`
+	// Default is the route when no route matches
+	Default string      `yaml:"default" json:"default"`
+	Routes  []fileRoute `yaml:"routes" json:"routes"`
+}
+
+// fileRoute is a route of the routes file, via is direct, reject,
+// an upstream name or an upstream URL
+type fileRoute struct {
+	Name      string `yaml:"name" json:"name"`
+	Via       string `yaml:"via" json:"via"`
+	fileMatch `yaml:",inline"`
+}
+
+// route is a validated route, a nil dial rejects the connection
+type route struct {
+	name string
+	dial dialFunc
+	requestMatcher
+}
+
+// routeTable is an ordered list of routes, the first matching route wins.
+// usesIP is set when a route matches destination networks.
+type routeTable struct {
+	routes       []route
+	defaultRoute route
+	usesIP       bool
+}
+
+// Router dials destinations directly or through upstream proxies
+// according to the routes file, reloaded when the file changes
+type Router struct {
+	path     string
+	direct   dialFunc
+	fallback dialFunc
+	timeout  time.Duration
+
+	mu    sync.RWMutex
+	table *routeTable
+}
+
+// NewRouter loads the routes file and starts watching it. Direct
+// routes use the direct dial, and without a default route connections
+// use the fallback dial, or the direct dial when nil.
+func NewRouter(path string, direct, fallback dialFunc, timeout time.Duration) (*Router, error) {
+	if direct == nil {
+		direct = (&net.Dialer{}).DialContext
+	}
+	if fallback == nil {
+		fallback = direct
+	}
+	r := &Router{path: path, direct: direct, fallback: fallback, timeout: timeout}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	watchFiles(func() {
+		if err := r.reload(); err != nil {
+			log.Printf("[ERR] routes: Failed to reload %s, keeping the previous routes: %v", r.path, err)
+			return
+		}
+		log.Printf("[INFO] routes: Reloaded routes from %s", r.path)
+	}, path)
+	return r, nil
+}
+
+func (r *Router) reload() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var file routesFile
+	if err := unmarshalConfig(r.path, data, &file); err != nil {
+		return err
+	}
+	table, err := r.parseRoutes(file)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.table = table
+	r.mu.Unlock()
+	return nil
+}
+
+// parseRoutes validates the routes file
+func (r *Router) parseRoutes(file routesFile) (*routeTable, error) {
+	upstreams := make(map[string]dialFunc)
+	for name, rawURL := range file.Upstreams {
+		if name == "direct" || name == "reject" {
+			return nil, fmt.Errorf("upstream name %q is reserved", name)
+		}
+		up, err := newUpstream(rawURL, r.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", name, err)
+		}
+		upstreams[name] = up.Dial
+	}
+
+	table := &routeTable{defaultRoute: route{name: "default", dial: r.fallback}}
+	var err error
+	if file.Default != "" {
+		if table.defaultRoute.dial, err = r.parseVia(file.Default, upstreams); err != nil {
+			return nil, fmt.Errorf("default: %v", err)
+		}
+	}
+
+	for i, fr := range file.Routes {
+		parsed := route{name: fr.Name}
+		if parsed.name == "" {
+			parsed.name = fmt.Sprintf("#%d", i+1)
+		}
+		if parsed.dial, err = r.parseVia(fr.Via, upstreams); err != nil {
+			return nil, fmt.Errorf("route %s: %v", parsed.name, err)
+		}
+		if parsed.requestMatcher, err = parseMatcher(fr.fileMatch); err != nil {
+			return nil, fmt.Errorf("route %s: %v", parsed.name, err)
+		}
+		table.usesIP = table.usesIP || parsed.networks != nil
+		table.routes = append(table.routes, parsed)
+	}
+	return table, nil
+}
+
+// parseVia returns the dial of a route, nil for reject
+func (r *Router) parseVia(via string, upstreams map[string]dialFunc) (dialFunc, error) {
+	switch {
+	case via == "direct":
+		return r.direct, nil
+	case via == "reject":
+		return nil, nil
+	case strings.Contains(via, "://"):
+		up, err := newUpstream(via, r.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return up.Dial, nil
+	}
+	dial, ok := upstreams[via]
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream %q", via)
+	}
+	return dial, nil
+}
+
+// Dial connects to addr using the first route matching the request
+// found in the context, rejected connections get a ruleFailure reply.
+// A destination sent by name is resolved only to match network routes.
+func (r *Router) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	r.mu.RLock()
+	table := r.table
+	r.mu.RUnlock()
+
+	selected := &table.defaultRoute
+	if req, ok := socks5.RequestFromContext(ctx); ok {
+		if table.usesIP && req.DestAddr.IP == nil && req.DestAddr.FQDN != "" {
+			ip, err := socks5.LookupIP(ctx, req.DestAddr.FQDN)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", socks5.ErrHostUnreachable, err)
+			}
+			resolved := *req
+			resolved.DestAddr = &socks5.AddrSpec{FQDN: req.DestAddr.FQDN, IP: ip, Port: req.DestAddr.Port}
+			req = &resolved
+		}
+		for i := range table.routes {
+			if table.routes[i].match(req) {
+				selected = &table.routes[i]
+				break
+			}
+		}
+	}
+
+	if selected.dial == nil {
+		return nil, fmt.Errorf("%w: rejected by route %s", socks5.ErrRuleFailure, selected.name)
+	}
+	return selected.dial(ctx, network, addr)
+}
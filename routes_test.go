@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+func TestRouter(t *testing.T) {
+	echo := echoServer(t)
+	jump := serveUpstream(t, &socks5.Config{})
+
+	// The jump proxy only accepts connections when the route uses it
+	counted := make(chan struct{}, 10)
+	jumpProxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer jumpProxy.Close()
+	go func() {
+		for {
+			conn, err := jumpProxy.Accept()
+			if err != nil {
+				return
+			}
+			counted <- struct{}{}
+			go func() {
+				defer conn.Close()
+				target, err := net.Dial("tcp", jump)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	routes := `
+upstreams:
+  jump: socks5://` + jumpProxy.Addr().String() + `
+default: reject
+routes:
+  - name: internal
+    destinations: ["*.internal.corp"]
+    via: direct
+  - name: office
+    destinations: ["127.0.0.0/8"]
+    users: [ci]
+    via: jump
+`
+	if err := os.WriteFile(path, []byte(routes), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	router, err := NewRouter(path, nil, nil, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dial := func(user, fqdn string) (net.Conn, error) {
+		addr := echo.Addr().(*net.TCPAddr)
+		req := &socks5.Request{
+			Command:     socks5.ConnectCommand,
+			AuthContext: &socks5.AuthContext{Payload: map[string]string{"Username": user}},
+			DestAddr:    &socks5.AddrSpec{FQDN: fqdn, IP: addr.IP, Port: addr.Port},
+		}
+		return router.Dial(socks5.WithRequest(context.Background(), req), "tcp", addr.String())
+	}
+
+	conn, err := dial("bob", "db.internal.corp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if len(counted) != 0 {
+		t.Fatalf("direct route used the jump proxy")
+	}
+
+	conn, err = dial("ci", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if len(counted) != 1 {
+		t.Fatalf("jump route did not use the jump proxy")
+	}
+
+	if _, err := dial("bob", ""); !errors.Is(err, socks5.ErrRuleFailure) {
+		t.Fatalf("expected reject, got %v", err)
+	}
+
+	// A name sent to the router is resolved to match the network route
+	port := echo.Addr().(*net.TCPAddr).Port
+	req := &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		AuthContext: &socks5.AuthContext{Payload: map[string]string{"Username": "ci"}},
+		DestAddr:    &socks5.AddrSpec{FQDN: "office.test", Port: port},
+	}
+	ctx := socks5.WithConfig(context.Background(), &socks5.Config{Resolver: hostsResolver{"office.test": net.IPv4(127, 0, 0, 1)}})
+	conn, err = router.Dial(socks5.WithRequest(ctx, req), "tcp", net.JoinHostPort("office.test", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if len(counted) != 2 {
+		t.Fatalf("jump route did not match the resolved name")
+	}
+
+	if err := os.WriteFile(path, []byte("routes: [{via: nowhere}]"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := router.reload(); err == nil {
+		t.Fatalf("expected unknown upstream error")
+	}
+}
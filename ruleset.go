@@ -1,24 +1,226 @@
 package main
 
 import (
-	"regexp"
+	"fmt"
+	"strings"
 
-	"github.com/armon/go-socks5"
+	"github.com/serjs/socks5-server/go-socks5"
 	"golang.org/x/net/context"
 )
 
-// PermitDestAddrPattern returns a RuleSet which selectively allows addresses
-func PermitDestAddrPattern(pattern string) socks5.RuleSet {
-	return &PermitDestAddrPatternRuleSet{pattern}
+// PermitDestPorts returns a RuleSet which allows destination ports in
+// allowed, or any port when it is empty, except the ones in denied
+func PermitDestPorts(allowed, denied []socks5.PortRange) socks5.RuleSet {
+	return &PermitDestPortsRuleSet{allowed, denied}
 }
 
-// PermitDestAddrPatternRuleSet is an implementation of the RuleSet which
-// enables filtering supported destination address
-type PermitDestAddrPatternRuleSet struct {
-	AllowedFqdnPattern string
+// PermitDestPortsRuleSet is an implementation of the RuleSet which
+// enables filtering destination ports
+type PermitDestPortsRuleSet struct {
+	AllowedPorts []socks5.PortRange
+	DeniedPorts  []socks5.PortRange
 }
 
-func (p *PermitDestAddrPatternRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
-	match, _ := regexp.MatchString(p.AllowedFqdnPattern, req.DestAddr.FQDN)
-	return ctx, match
+func (p *PermitDestPortsRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if noDestination(req) {
+		return ctx, true
+	}
+	port := req.DestAddr.Port
+	if containsPort(p.DeniedPorts, port) {
+		return socks5.WithRuleReason(ctx, fmt.Sprintf("port %d is denied", port)), false
+	}
+	if len(p.AllowedPorts) > 0 && !containsPort(p.AllowedPorts, port) {
+		return socks5.WithRuleReason(ctx, fmt.Sprintf("port %d is not allowed", port)), false
+	}
+	return ctx, true
+}
+
+func containsPort(ranges []socks5.PortRange, port int) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRanges parses a list of ports and port ranges like 80,443,8000-8100
+func parsePortRanges(specs []string) ([]socks5.PortRange, error) {
+	var ranges []socks5.PortRange
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		r, err := socks5.ParsePortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// noDestination reports whether the request has no destination to check:
+// a UDP ASSOCIATE request states the client address, and each of its
+// datagrams is checked against its own destination, and a BIND request
+// may leave the peer unspecified
+func noDestination(req *socks5.Request) bool {
+	if req.Command == socks5.AssociateCommand {
+		return !req.Datagram
+	}
+	dest := req.DestAddr
+	return req.Command == socks5.BindCommand && dest.FQDN == "" && (dest.IP == nil || dest.IP.IsUnspecified())
+}
+
+// UsesDestIP is false, only the port is checked
+func (p *PermitDestPortsRuleSet) UsesDestIP() bool {
+	return false
+}
+
+// PermitUserCommandsRuleSet is an implementation of the RuleSet which
+// enables commands per authenticated username, users not listed
+// get the DefaultCommands
+type PermitUserCommandsRuleSet struct {
+	DefaultCommands map[uint8]bool
+	UserCommands    map[string]map[uint8]bool
+}
+
+func (p *PermitUserCommandsRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	var user string
+	if req.AuthContext != nil {
+		user = req.AuthContext.Payload["Username"]
+	}
+	commands, ok := p.UserCommands[user]
+	if !ok {
+		commands = p.DefaultCommands
+	}
+	if !commands[req.Command] {
+		name := commandLabel(req.Command)
+		if user == "" {
+			return socks5.WithRuleReason(ctx, fmt.Sprintf("%s command is not enabled", name)), false
+		}
+		return socks5.WithRuleReason(ctx, fmt.Sprintf("%s command is not enabled for user %s", name, user)), false
+	}
+	return ctx, true
+}
+
+// UsesDestIP is false, only the user and command are checked
+func (p *PermitUserCommandsRuleSet) UsesDestIP() bool {
+	return false
+}
+
+// commandLabel returns the rules file name of the command
+func commandLabel(command uint8) string {
+	for name, c := range commandNames {
+		if c == command {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown (%d)", command)
+}
+
+// parseCommands parses a list of command names
+func parseCommands(names []string) (map[uint8]bool, error) {
+	commands := make(map[uint8]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		command, ok := commandNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown command %q", name)
+		}
+		commands[command] = true
+	}
+	return commands, nil
+}
+
+// newCommands builds the commands served by the server from the app params.
+// Users of USER_COMMANDS ("user:connect,bind;other:connect") get their own
+// commands instead of ENABLED_COMMANDS, checked by the returned RuleSet.
+func newCommands(cfg params) ([]uint8, socks5.RuleSet, error) {
+	defaults, err := parseCommands(cfg.EnabledCommands)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ENABLED_COMMANDS: %v", err)
+	}
+
+	served := make(map[uint8]bool)
+	for command := range defaults {
+		served[command] = true
+	}
+	users := make(map[string]map[uint8]bool)
+	for _, entry := range cfg.UserCommands {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		user, names, ok := strings.Cut(entry, ":")
+		user = strings.TrimSpace(user)
+		if !ok || user == "" {
+			return nil, nil, fmt.Errorf("USER_COMMANDS: expected user:commands, got %q", entry)
+		}
+		commands, err := parseCommands(strings.Split(names, ","))
+		if err != nil {
+			return nil, nil, fmt.Errorf("USER_COMMANDS: %s: %v", user, err)
+		}
+		users[user] = commands
+		for command := range commands {
+			served[command] = true
+		}
+	}
+
+	list := make([]uint8, 0, len(served))
+	for command := range served {
+		list = append(list, command)
+	}
+	if len(users) == 0 {
+		return list, nil, nil
+	}
+	return list, &PermitUserCommandsRuleSet{DefaultCommands: defaults, UserCommands: users}, nil
+}
+
+// newRules builds the RuleSet from the app params and the USER_COMMANDS
+// rules of newCommands, chaining every enabled policy with AllOf. It is
+// nil when no rules are configured.
+func newRules(cfg params, userCommands socks5.RuleSet) (socks5.RuleSet, error) {
+	var rules []socks5.RuleSet
+
+	// Commands of the authenticated user
+	if userCommands != nil {
+		rules = append(rules, userCommands)
+	}
+
+	// Destination FQDN and IP rules
+	destPolicy, err := newDestPolicy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination rules: %v", err)
+	}
+	if destPolicy != nil {
+		rules = append(rules, destPolicy)
+	}
+
+	allowedPorts, err := parsePortRanges(cfg.AllowedDestPorts)
+	if err != nil {
+		return nil, fmt.Errorf("ALLOWED_DEST_PORTS: %v", err)
+	}
+	deniedPorts, err := parsePortRanges(cfg.DeniedDestPorts)
+	if err != nil {
+		return nil, fmt.Errorf("DENIED_DEST_PORTS: %v", err)
+	}
+	if len(allowedPorts) > 0 || len(deniedPorts) > 0 {
+		rules = append(rules, PermitDestPorts(allowedPorts, deniedPorts))
+	}
+
+	if cfg.RulesFile != "" {
+		fileRules, err := NewFileRuleSet(cfg.RulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load RULES_FILE: %v", err)
+		}
+		rules = append(rules, fileRules)
+	}
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return socks5.AllOf(rules...), nil
 }
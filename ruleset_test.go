@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+func TestPermitDestPorts(t *testing.T) {
+	allowed, err := parsePortRanges([]string{"80", "443", "8000-8100", ""})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	denied, err := parsePortRanges([]string{"8025"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rules := PermitDestPorts(allowed, denied)
+
+	for port, want := range map[int]bool{80: true, 443: true, 8050: true, 8025: false, 25: false, 22: false} {
+		req := &socks5.Request{
+			Command:  socks5.ConnectCommand,
+			DestAddr: &socks5.AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: port},
+		}
+		if _, ok := rules.Allow(context.Background(), req); ok != want {
+			t.Errorf("port %d: got %v, want %v", port, ok, want)
+		}
+	}
+
+	// The port of an associate request is the client's source port
+	req := &socks5.Request{
+		Command:  socks5.AssociateCommand,
+		DestAddr: &socks5.AddrSpec{IP: net.IPv4(10, 0, 0, 5), Port: 5000},
+	}
+	if _, ok := rules.Allow(context.Background(), req); !ok {
+		t.Errorf("associate from port 5000 denied")
+	}
+	req.Datagram = true
+	if _, ok := rules.Allow(context.Background(), req); ok {
+		t.Errorf("datagram to port 5000 allowed")
+	}
+
+	if _, err := parsePortRanges([]string{"80-70"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	served, rules, err := newCommands(params{
+		EnabledCommands: []string{"connect"},
+		UserCommands:    []string{"alice:connect,bind", "ci:associate", ""},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(served) != 3 {
+		t.Fatalf("bad served commands: %v", served)
+	}
+
+	for _, tc := range []struct {
+		user    string
+		command uint8
+		allow   bool
+	}{
+		{"", socks5.ConnectCommand, true},
+		{"bob", socks5.ConnectCommand, true},
+		{"bob", socks5.BindCommand, false},
+		{"alice", socks5.BindCommand, true},
+		{"ci", socks5.AssociateCommand, true},
+		{"ci", socks5.ConnectCommand, false},
+	} {
+		req := &socks5.Request{
+			Command:     tc.command,
+			AuthContext: &socks5.AuthContext{Payload: map[string]string{"Username": tc.user}},
+			DestAddr:    &socks5.AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 80},
+		}
+		if _, ok := rules.Allow(context.Background(), req); ok != tc.allow {
+			t.Errorf("%q command %d: got %v, want %v", tc.user, tc.command, ok, tc.allow)
+		}
+	}
+
+	for _, bad := range []params{
+		{EnabledCommands: []string{"ping"}},
+		{UserCommands: []string{"alice"}},
+		{UserCommands: []string{"alice:connect,ping"}},
+	} {
+		if _, _, err := newCommands(bad); err == nil {
+			t.Errorf("%v: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// commandNames maps the command names of the rules file to SOCKS commands
+var commandNames = map[string]uint8{
+	"connect":   socks5.ConnectCommand,
+	"bind":      socks5.BindCommand,
+	"associate": socks5.AssociateCommand,
+}
+
+// rulesFile is the YAML or JSON format of the rules file
+type rulesFile struct {
+	// Default is the action when no rule matches, allow or deny
+	Default string     `yaml:"default" json:"default"`
+	Rules   []fileRule `yaml:"rules" json:"rules"`
+}
+
+// fileRule is a rule of the rules file
+type fileRule struct {
+	Name      string `yaml:"name" json:"name"`
+	Action    string `yaml:"action" json:"action"`
+	fileMatch `yaml:",inline"`
+}
+
+// fileMatch matches requests on all of its non-empty fields,
+// and any of the values of a field
+type fileMatch struct {
+	Users        []string   `yaml:"users" json:"users"`
+	Sources      []string   `yaml:"sources" json:"sources"`
+	Destinations []string   `yaml:"destinations" json:"destinations"`
+	Ports        []portSpec `yaml:"ports" json:"ports"`
+	Commands     []string   `yaml:"commands" json:"commands"`
+}
+
+// portSpec is a port or a port range, written as a number or a string
+type portSpec string
+
+func (p *portSpec) UnmarshalJSON(data []byte) error {
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		*p = portSpec(strconv.Itoa(port))
+		return nil
+	}
+	return json.Unmarshal(data, (*string)(p))
+}
+
+// aclRule is a validated rule of the rules file
+type aclRule struct {
+	name  string
+	allow bool
+	requestMatcher
+}
+
+// requestMatcher is a validated fileMatch
+type requestMatcher struct {
+	users    map[string]bool
+	sources  *prefixTrie
+	domains  []*regexp.Regexp
+	networks *prefixTrie
+	ports    []socks5.PortRange
+	commands map[uint8]bool
+}
+
+// acl is an ordered list of rules, the first matching rule wins
+type acl struct {
+	rules        []aclRule
+	defaultAllow bool
+}
+
+// FileRuleSet is an implementation of the RuleSet which applies the
+// rules of a YAML or JSON file, reloaded when the file changes
+type FileRuleSet struct {
+	path string
+
+	mu  sync.RWMutex
+	acl *acl
+}
+
+// NewFileRuleSet loads the rules file and starts watching it
+func NewFileRuleSet(path string) (*FileRuleSet, error) {
+	r := &FileRuleSet{path: path}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	watchFiles(func() {
+		if err := r.reload(); err != nil {
+			log.Printf("[ERR] rules: Failed to reload %s, keeping the previous rules: %v", r.path, err)
+			return
+		}
+		log.Printf("[INFO] rules: Reloaded rules from %s", r.path)
+	}, path)
+	return r, nil
+}
+
+func (r *FileRuleSet) reload() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var file rulesFile
+	if err := unmarshalConfig(r.path, data, &file); err != nil {
+		return err
+	}
+	acl, err := parseACL(file)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.acl = acl
+	r.mu.Unlock()
+	return nil
+}
+
+// unmarshalConfig decodes a JSON file by its .json extension, YAML otherwise
+func unmarshalConfig(path string, data []byte, v interface{}) error {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return json.Unmarshal(data, v)
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+func (r *FileRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	r.mu.RLock()
+	acl := r.acl
+	r.mu.RUnlock()
+
+	for i := range acl.rules {
+		if rule := &acl.rules[i]; rule.match(req) {
+			return socks5.WithRuleReason(ctx, fmt.Sprintf("%s by rule %s of %s", action(rule.allow), rule.name, r.path)), rule.allow
+		}
+	}
+	return socks5.WithRuleReason(ctx, fmt.Sprintf("%s by default of %s", action(acl.defaultAllow), r.path)), acl.defaultAllow
+}
+
+// UsesDestIP reports whether a rule matches destination networks
+func (r *FileRuleSet) UsesDestIP() bool {
+	r.mu.RLock()
+	acl := r.acl
+	r.mu.RUnlock()
+	for i := range acl.rules {
+		if acl.rules[i].networks != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func action(allow bool) string {
+	if allow {
+		return "allowed"
+	}
+	return "denied"
+}
+
+// parseACL validates the rules file
+func parseACL(file rulesFile) (*acl, error) {
+	a := &acl{}
+	switch file.Default {
+	case "allow":
+		a.defaultAllow = true
+	case "deny", "":
+	default:
+		return nil, fmt.Errorf("default must be allow or deny, not %q", file.Default)
+	}
+
+	for i, rule := range file.Rules {
+		parsed, err := parseRule(rule)
+		if err != nil {
+			if rule.Name != "" {
+				return nil, fmt.Errorf("rule %d (%s): %v", i+1, rule.Name, err)
+			}
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		if parsed.name == "" {
+			parsed.name = fmt.Sprintf("#%d", i+1)
+		}
+		a.rules = append(a.rules, parsed)
+	}
+	return a, nil
+}
+
+func parseRule(rule fileRule) (aclRule, error) {
+	parsed := aclRule{name: rule.Name}
+	switch rule.Action {
+	case "allow":
+		parsed.allow = true
+	case "deny":
+	default:
+		return parsed, fmt.Errorf("action must be allow or deny, not %q", rule.Action)
+	}
+
+	var err error
+	parsed.requestMatcher, err = parseMatcher(rule.fileMatch)
+	return parsed, err
+}
+
+// parseMatcher validates the match conditions of a rule
+func parseMatcher(rule fileMatch) (requestMatcher, error) {
+	var parsed requestMatcher
+	if len(rule.Users) > 0 {
+		parsed.users = make(map[string]bool)
+		for _, user := range rule.Users {
+			parsed.users[user] = true
+		}
+	}
+
+	var err error
+	if len(rule.Sources) > 0 {
+		if parsed.sources, err = newPrefixTrie(rule.Sources); err != nil {
+			return parsed, fmt.Errorf("sources: %v", err)
+		}
+	}
+
+	// Destinations are CIDRs or IPs, /regular expressions/ or domain globs
+	var networks []string
+	for _, dest := range rule.Destinations {
+		switch {
+		case len(dest) > 1 && strings.HasPrefix(dest, "/") && strings.HasSuffix(dest, "/"):
+			re, err := regexp.Compile(dest[1 : len(dest)-1])
+			if err != nil {
+				return parsed, fmt.Errorf("destinations: %v", err)
+			}
+			parsed.domains = append(parsed.domains, re)
+		case isNetwork(dest):
+			networks = append(networks, dest)
+		default:
+			re, err := globRegexp(dest)
+			if err != nil {
+				return parsed, fmt.Errorf("destinations: %v", err)
+			}
+			parsed.domains = append(parsed.domains, re)
+		}
+	}
+	if len(networks) > 0 {
+		if parsed.networks, err = newPrefixTrie(networks); err != nil {
+			return parsed, fmt.Errorf("destinations: %v", err)
+		}
+	}
+
+	for _, ports := range rule.Ports {
+		portRange, err := socks5.ParsePortRange(string(ports))
+		if err == nil && portRange.First == 0 {
+			err = fmt.Errorf("empty port range")
+		}
+		if err != nil {
+			return parsed, fmt.Errorf("ports: %v", err)
+		}
+		parsed.ports = append(parsed.ports, portRange)
+	}
+
+	if len(rule.Commands) > 0 {
+		parsed.commands = make(map[uint8]bool)
+		for _, name := range rule.Commands {
+			command, ok := commandNames[strings.ToLower(name)]
+			if !ok {
+				return parsed, fmt.Errorf("unknown command %q", name)
+			}
+			parsed.commands[command] = true
+		}
+	}
+	return parsed, nil
+}
+
+// isNetwork reports whether the destination is an IP or a CIDR
+func isNetwork(dest string) bool {
+	_, err := parsePrefix(dest)
+	return err == nil
+}
+
+// globRegexp compiles a case-insensitive domain glob, where * matches
+// any characters including dots and ? a single character
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, fmt.Errorf("empty destination")
+	}
+	pattern := regexp.QuoteMeta(strings.ToLower(glob))
+	pattern = strings.ReplaceAll(pattern, `\*`, `.*`)
+	pattern = strings.ReplaceAll(pattern, `\?`, `.`)
+	return regexp.Compile(`(?i)^` + pattern + `\.?$`)
+}
+
+// match reports whether the request matches all the conditions
+func (r *requestMatcher) match(req *socks5.Request) bool {
+	if r.users != nil {
+		if req.AuthContext == nil || !r.users[req.AuthContext.Payload["Username"]] {
+			return false
+		}
+	}
+	if r.sources != nil {
+		if req.RemoteAddr == nil || !r.sources.ContainsIP(req.RemoteAddr.IP) {
+			return false
+		}
+	}
+	if r.domains != nil || r.networks != nil {
+		if !r.matchDestination(req.DestAddr) {
+			return false
+		}
+	}
+	if r.ports != nil {
+		matched := false
+		for _, ports := range r.ports {
+			if ports.Contains(req.DestAddr.Port) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.commands != nil && !r.commands[req.Command] {
+		return false
+	}
+	return true
+}
+
+// matchDestination matches domains against the FQDN and
+// networks against the resolved IP
+func (r *requestMatcher) matchDestination(dest *socks5.AddrSpec) bool {
+	if dest.FQDN != "" {
+		for _, re := range r.domains {
+			if re.MatchString(dest.FQDN) {
+				return true
+			}
+		}
+	}
+	return r.networks != nil && dest.IP != nil && r.networks.ContainsIP(dest.IP)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+const testRules = `
+default: allow
+rules:
+  - name: ci to github only
+    action: allow
+    users: [ci]
+    destinations: ["*.github.com", "140.82.112.0/20"]
+    ports: [443]
+  - action: deny
+    users: [ci]
+  - name: no bind from the office
+    action: deny
+    sources: [10.1.0.0/16]
+    commands: [bind]
+  - action: deny
+    destinations: ["/^(.*\\.)?internal$/"]
+    ports: ["8000-8100", 22]
+`
+
+func TestFileRuleSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(testRules), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rules, err := NewFileRuleSet(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		user    string
+		source  string
+		command uint8
+		fqdn    string
+		ip      string
+		port    int
+		allow   bool
+	}{
+		{"ci", "192.0.2.1", socks5.ConnectCommand, "api.github.com", "140.82.112.5", 443, true},
+		{"ci", "192.0.2.1", socks5.ConnectCommand, "", "140.82.112.5", 443, true},
+		{"ci", "192.0.2.1", socks5.ConnectCommand, "api.github.com", "140.82.112.5", 80, false},
+		{"ci", "192.0.2.1", socks5.ConnectCommand, "example.com", "93.184.216.34", 443, false},
+		{"bob", "10.1.2.3", socks5.BindCommand, "", "0.0.0.0", 0, false},
+		{"bob", "10.2.2.3", socks5.BindCommand, "", "0.0.0.0", 0, true},
+		{"bob", "192.0.2.1", socks5.ConnectCommand, "db.internal", "10.0.0.5", 8080, false},
+		{"bob", "192.0.2.1", socks5.ConnectCommand, "db.internal", "10.0.0.5", 443, true},
+	} {
+		req := &socks5.Request{
+			Command:     tc.command,
+			AuthContext: &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: map[string]string{"Username": tc.user}},
+			RemoteAddr:  &socks5.AddrSpec{IP: net.ParseIP(tc.source), Port: 4000},
+			DestAddr:    &socks5.AddrSpec{FQDN: tc.fqdn, IP: net.ParseIP(tc.ip), Port: tc.port},
+		}
+		if _, allow := rules.Allow(context.Background(), req); allow != tc.allow {
+			t.Errorf("%s from %s to %v: got %v, want %v", tc.user, tc.source, req.DestAddr, allow, tc.allow)
+		}
+	}
+
+	// Invalid files are refused
+	for _, bad := range []string{
+		`rules: [{action: maybe}]`,
+		`rules: [{action: deny, sources: [10.0.0.0/40]}]`,
+		`rules: [{action: deny, ports: ["90-80"]}]`,
+		`rules: [{action: deny, commands: [ping]}]`,
+		`default: sometimes`,
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := rules.reload(); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+
+	// JSON files with numeric ports
+	path = filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{"rules": [{"action": "allow", "ports": [443, "8000-8100"]}]}`), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewFileRuleSet(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -1,21 +1,98 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 	"os"
-	"github.com/armon/go-socks5"
+	"time"
+
 	"github.com/caarlos0/env/v6"
+	"github.com/serjs/socks5-server/go-socks5"
 )
 
 type params struct {
-	User            string    `env:"PROXY_USER" envDefault:""`
-	Password        string    `env:"PROXY_PASSWORD" envDefault:""`
-	Port            string    `env:"PROXY_PORT" envDefault:"1080"`
-	AllowedDestFqdn string    `env:"ALLOWED_DEST_FQDN" envDefault:""`
-	AllowedIPs      []string  `env:"ALLOWED_IPS" envSeparator:"," envDefault:""`
-	ListenIP 		string 	  `env:"PROXY_LISTEN_IP" envDefault:"0.0.0.0"`
-	RequireAuth		bool      `env:"REQUIRE_AUTH" envDefault:"true"`
+	User                     string        `env:"PROXY_USER" envDefault:""`
+	Password                 string        `env:"PROXY_PASSWORD" envDefault:""`
+	UsersFile                string        `env:"PROXY_USERS_FILE" envDefault:""`
+	AuthHTTPURL              string        `env:"AUTH_HTTP_URL" envDefault:""`
+	AuthHTTPTimeout          time.Duration `env:"AUTH_HTTP_TIMEOUT" envDefault:"5s"`
+	AuthCacheTTL             time.Duration `env:"AUTH_CACHE_TTL" envDefault:"5m"`
+	AuthNegativeCacheTTL     time.Duration `env:"AUTH_NEGATIVE_CACHE_TTL" envDefault:"30s"`
+	LDAPURL                  string        `env:"LDAP_URL" envDefault:""`
+	LDAPBindDN               string        `env:"LDAP_BIND_DN" envDefault:""`
+	LDAPBindPassword         string        `env:"LDAP_BIND_PASSWORD" envDefault:""`
+	LDAPBaseDN               string        `env:"LDAP_BASE_DN" envDefault:""`
+	LDAPUserFilter           string        `env:"LDAP_USER_FILTER" envDefault:"(uid=%s)"`
+	LDAPGroupDN              string        `env:"LDAP_GROUP_DN" envDefault:""`
+	LDAPStartTLS             bool          `env:"LDAP_START_TLS" envDefault:"false"`
+	LDAPCAFile               string        `env:"LDAP_CA_FILE" envDefault:""`
+	LDAPTimeout              time.Duration `env:"LDAP_TIMEOUT" envDefault:"5s"`
+	LDAPPoolSize             int           `env:"LDAP_POOL_SIZE" envDefault:"4"`
+	RADIUSServers            []string      `env:"RADIUS_SERVERS" envSeparator:"," envDefault:""`
+	RADIUSSecret             string        `env:"RADIUS_SECRET" envDefault:""`
+	RADIUSTimeout            time.Duration `env:"RADIUS_TIMEOUT" envDefault:"3s"`
+	RADIUSRetries            int           `env:"RADIUS_RETRIES" envDefault:"2"`
+	RADIUSNASIdentifier      string        `env:"RADIUS_NAS_IDENTIFIER" envDefault:"socks5-server"`
+	RADIUSRequireMessageAuth bool          `env:"RADIUS_REQUIRE_MESSAGE_AUTHENTICATOR" envDefault:"true"`
+	Port                     string        `env:"PROXY_PORT" envDefault:"1080"`
+	AllowedDestFqdn          string        `env:"ALLOWED_DEST_FQDN" envDefault:""`
+	AllowedDestPorts         []string      `env:"ALLOWED_DEST_PORTS" envSeparator:"," envDefault:""`
+	DeniedDestPorts          []string      `env:"DENIED_DEST_PORTS" envSeparator:"," envDefault:""`
+	RulesFile                string        `env:"RULES_FILE" envDefault:""`
+	AllowedDestIPs           []string      `env:"ALLOWED_DEST_IPS" envSeparator:"," envDefault:""`
+	DeniedDestIPs            []string      `env:"DENIED_DEST_IPS" envSeparator:"," envDefault:""`
+	BlockPrivateDests        bool          `env:"BLOCK_PRIVATE_DESTS" envDefault:"false"`
+	AllowedIPs               []string      `env:"ALLOWED_IPS" envSeparator:"," envDefault:""`
+	DeniedIPs                []string      `env:"DENIED_IPS" envSeparator:"," envDefault:""`
+	BanMaxFailures           int           `env:"BAN_MAX_FAILURES" envDefault:"0"`
+	BanFindTime              time.Duration `env:"BAN_FIND_TIME" envDefault:"10m"`
+	BanTime                  time.Duration `env:"BAN_TIME" envDefault:"1h"`
+	BanStateFile             string        `env:"BAN_STATE_FILE" envDefault:""`
+	ListenIP                 string        `env:"PROXY_LISTEN_IP" envDefault:"0.0.0.0"`
+	RequireAuth              bool          `env:"REQUIRE_AUTH" envDefault:"true"`
+	BindIP                   string        `env:"PROXY_BIND_IP" envDefault:""`
+	OutboundIPv4             string        `env:"OUTBOUND_IPV4" envDefault:""`
+	OutboundIPv6             string        `env:"OUTBOUND_IPV6" envDefault:""`
+	OutboundInterface        string        `env:"OUTBOUND_INTERFACE" envDefault:""`
+	EgressAddresses          []string      `env:"EGRESS_ADDRESSES" envSeparator:"," envDefault:""`
+	EgressStrategy           string        `env:"EGRESS_STRATEGY" envDefault:"random"`
+	EgressFreeBind           bool          `env:"EGRESS_FREEBIND" envDefault:"false"`
+	IPFamily                 string        `env:"IP_FAMILY" envDefault:"prefer-ipv4"`
+	HappyEyeballsDelay       time.Duration `env:"HAPPY_EYEBALLS_DELAY" envDefault:"250ms"`
+	DNSServers               []string      `env:"DNS_SERVERS" envSeparator:"," envDefault:""`
+	DNSTimeout               time.Duration `env:"DNS_TIMEOUT" envDefault:"2s"`
+	UDPPortRange             string        `env:"UDP_PORT_RANGE" envDefault:""`
+	BindPortRange            string        `env:"BIND_PORT_RANGE" envDefault:""`
+	BindTimeout              time.Duration `env:"BIND_TIMEOUT" envDefault:"2m"`
+	EnabledCommands          []string      `env:"ENABLED_COMMANDS" envSeparator:"," envDefault:"connect"`
+	UserCommands             []string      `env:"USER_COMMANDS" envSeparator:";" envDefault:""`
+	UpstreamProxy            []string      `env:"UPSTREAM_PROXY" envSeparator:"," envDefault:""`
+	UpstreamTimeout          time.Duration `env:"UPSTREAM_TIMEOUT" envDefault:"10s"`
+	UpstreamStrategy         string        `env:"UPSTREAM_STRATEGY" envDefault:"round-robin"`
+	UpstreamHealthInterval   time.Duration `env:"UPSTREAM_HEALTH_INTERVAL" envDefault:"10s"`
+	UpstreamMaxFailures      int           `env:"UPSTREAM_MAX_FAILURES" envDefault:"3"`
+	UpstreamEjectTime        time.Duration `env:"UPSTREAM_EJECT_TIME" envDefault:"30s"`
+	UpstreamRetries          int           `env:"UPSTREAM_RETRIES" envDefault:"2"`
+	RoutesFile               string        `env:"ROUTES_FILE" envDefault:""`
+	SSHEgressHost            string        `env:"SSH_EGRESS_HOST" envDefault:""`
+	SSHEgressUser            string        `env:"SSH_EGRESS_USER" envDefault:""`
+	SSHEgressKeyFile         string        `env:"SSH_EGRESS_KEY_FILE" envDefault:""`
+	SSHEgressKnownHosts      string        `env:"SSH_EGRESS_KNOWN_HOSTS" envDefault:""`
+	SSHEgressInsecureHostKey bool          `env:"SSH_EGRESS_INSECURE_HOST_KEY" envDefault:"false"`
+	SSHEgressKeepalive       time.Duration `env:"SSH_EGRESS_KEEPALIVE" envDefault:"30s"`
+	SSHEgressTimeout         time.Duration `env:"SSH_EGRESS_TIMEOUT" envDefault:"10s"`
+	EnableSOCKS4             bool          `env:"ENABLE_SOCKS4" envDefault:"false"`
+	EnableHTTPProxy          bool          `env:"ENABLE_HTTP_PROXY" envDefault:"false"`
+	TLSPort                  string        `env:"TLS_PORT" envDefault:""`
+	TLSCertFile              string        `env:"TLS_CERT_FILE" envDefault:""`
+	TLSKeyFile               string        `env:"TLS_KEY_FILE" envDefault:""`
+	TLSMinVersion            string        `env:"TLS_MIN_VERSION" envDefault:"1.2"`
+	TLSCipherSuites          []string      `env:"TLS_CIPHER_SUITES" envSeparator:"," envDefault:""`
+	TLSClientCAFile          string        `env:"TLS_CLIENT_CA_FILE" envDefault:""`
+	TLSClientAuth            string        `env:"TLS_CLIENT_AUTH" envDefault:"cert"`
+	TLSClientPattern         string        `env:"TLS_CLIENT_PATTERN" envDefault:""`
+	ReloadInterval           time.Duration `env:"RELOAD_INTERVAL" envDefault:"10s"`
 }
 
 func main() {
@@ -26,26 +103,181 @@ func main() {
 		log.Printf("%+v\n", err)
 	}
 
+	// Polling of the reloaded files
+	if cfg.ReloadInterval <= 0 {
+		log.Fatalf("Error: RELOAD_INTERVAL must be positive")
+	}
+	reloadInterval = cfg.ReloadInterval
+
 	//Initialize socks5 config
 	socks5conf := &socks5.Config{
-		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		Logger:       log.New(os.Stdout, "", log.LstdFlags),
+		EnableSOCKS4: cfg.EnableSOCKS4,
 	}
 
+	var creds socks5.CredentialStore
+	var clientCerts *ClientCertAuthenticator
 	if cfg.RequireAuth {
-		if cfg.User == "" || cfg.Password == "" {
-			log.Fatalln("Error: REQUIRE_AUTH is true, but PROXY_USER and PROXY_PASSWORD are not set.  The application will now exit.")
+		creds, err = newCredentials(cfg)
+		if err != nil {
+			log.Fatalf("Error: Failed to load credentials: %v", err)
+		}
+		if creds != nil {
+			cator := socks5.UserPassAuthenticator{Credentials: creds}
+			socks5conf.AuthMethods = []socks5.Authenticator{cator}
 		}
-		creds := socks5.StaticCredentials{
-			cfg.User: cfg.Password,
+
+		// TLS client certificates, alone or in addition to the password
+		if cfg.TLSClientCAFile != "" {
+			clientCerts, err = newClientCertAuthenticator(cfg, creds)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if clientCerts.Next != nil {
+				socks5conf.AuthMethods = []socks5.Authenticator{clientCerts}
+			} else {
+				socks5conf.AuthMethods = append([]socks5.Authenticator{clientCerts}, socks5conf.AuthMethods...)
+			}
+		}
+
+		if len(socks5conf.AuthMethods) == 0 {
+			log.Fatalln("Error: REQUIRE_AUTH is true, but no credentials are configured (PROXY_USER and PROXY_PASSWORD, PROXY_USERS_FILE, AUTH_HTTP_URL, LDAP_URL or RADIUS_SERVERS).  The application will now exit.")
 		}
-		cator := socks5.UserPassAuthenticator{Credentials: creds}
-		socks5conf.AuthMethods = []socks5.Authenticator{cator}
 	} else {
+		if cfg.TLSClientCAFile != "" {
+			log.Fatalln("Error: TLS_CLIENT_CA_FILE requires REQUIRE_AUTH=true, client certificates would not be checked.  The application will now exit.")
+		}
 		log.Println("Warning: Running the proxy server without authentication. This is NOT recommended for public servers.")
 	}
 
-	if cfg.AllowedDestFqdn != "" {
-		socks5conf.Rules = PermitDestAddrPattern(cfg.AllowedDestFqdn)
+	// Sockets opened for BIND and UDP associate
+	if cfg.BindIP != "" {
+		socks5conf.BindIP = net.ParseIP(cfg.BindIP)
+		if socks5conf.BindIP == nil {
+			log.Fatalf("Error: PROXY_BIND_IP %q is not a valid IP address", cfg.BindIP)
+		}
+	}
+
+	// Source of outbound connections
+	if cfg.OutboundIPv4 != "" {
+		socks5conf.SourceIPv4 = net.ParseIP(cfg.OutboundIPv4).To4()
+		if socks5conf.SourceIPv4 == nil {
+			log.Fatalf("Error: OUTBOUND_IPV4 %q is not a valid IPv4 address", cfg.OutboundIPv4)
+		}
+	}
+	if cfg.OutboundIPv6 != "" {
+		socks5conf.SourceIPv6 = net.ParseIP(cfg.OutboundIPv6)
+		if socks5conf.SourceIPv6 == nil || socks5conf.SourceIPv6.To4() != nil {
+			log.Fatalf("Error: OUTBOUND_IPV6 %q is not a valid IPv6 address", cfg.OutboundIPv6)
+		}
+	}
+	if cfg.OutboundInterface != "" {
+		if _, err := net.InterfaceByName(cfg.OutboundInterface); err != nil {
+			log.Fatalf("Error: OUTBOUND_INTERFACE: %v", err)
+		}
+		socks5conf.SourceInterface = cfg.OutboundInterface
+	}
+
+	// Source addresses rotated from a pool
+	if len(cfg.EgressAddresses) > 0 {
+		egress, err := newEgressPool(cfg)
+		if err != nil {
+			log.Fatalf("Error: EGRESS_ADDRESSES: %v", err)
+		}
+		socks5conf.SelectSourceIP = egress.Select
+	}
+	socks5conf.FreeBind = cfg.EgressFreeBind
+
+	// Resolve destinations with the configured nameservers
+	if len(cfg.DNSServers) > 0 {
+		resolver, err := newDNSResolver(cfg)
+		if err != nil {
+			log.Fatalf("Error: DNS_SERVERS: %v", err)
+		}
+		socks5conf.Resolver = resolver
+	}
+
+	// Families of destination addresses, raced Happy Eyeballs style
+	socks5conf.IPFamily, err = parseIPFamily(cfg.IPFamily)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	socks5conf.HappyEyeballsDelay = cfg.HappyEyeballsDelay
+
+	socks5conf.AssociatePorts, err = socks5.ParsePortRange(cfg.UDPPortRange)
+	if err != nil {
+		log.Fatalf("Error: UDP_PORT_RANGE: %v", err)
+	}
+	socks5conf.BindPorts, err = socks5.ParsePortRange(cfg.BindPortRange)
+	if err != nil {
+		log.Fatalf("Error: BIND_PORT_RANGE: %v", err)
+	}
+	socks5conf.BindTimeout = cfg.BindTimeout
+
+	// Temporary bans after repeated failed logins
+	var bans *banTracker
+	if cfg.BanMaxFailures > 0 {
+		bans, err = newBanTracker(cfg)
+		if err != nil {
+			log.Fatalf("Error: Failed to load BAN_STATE_FILE: %v", err)
+		}
+		socks5conf.OnAuthFailure = bans.Failed
+	}
+
+	// Commands served to anyone, and per user by the rules
+	var userCommands socks5.RuleSet
+	socks5conf.Commands, userCommands, err = newCommands(cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// Chain connections through an upstream proxy, or balance
+	// them over a pool of upstreams
+	if len(cfg.UpstreamProxy) > 0 {
+		pool, err := newUpstreamPool(cfg)
+		if err != nil {
+			log.Fatalf("Error: UPSTREAM_PROXY: %v", err)
+		}
+		socks5conf.Dial = pool.Dial
+		log.Printf("Connecting through upstream proxy %s", pool)
+	}
+
+	// Leave through an SSH server
+	if cfg.SSHEgressHost != "" {
+		if socks5conf.Dial != nil {
+			log.Fatalf("Error: SSH_EGRESS_HOST and UPSTREAM_PROXY cannot be used together")
+		}
+		egress, err := newSSHEgress(cfg)
+		if err != nil {
+			log.Fatalf("Error: SSH egress: %v", err)
+		}
+		socks5conf.Dial = egress.Dial
+		log.Printf("Connecting through SSH server %s", egress)
+	}
+
+	// Route destinations directly or through upstreams, the default
+	// route is UPSTREAM_PROXY or SSH_EGRESS_HOST when set
+	if cfg.RoutesFile != "" {
+		router, err := NewRouter(cfg.RoutesFile, socks5conf.DirectDial, socks5conf.Dial, cfg.UpstreamTimeout)
+		if err != nil {
+			log.Fatalf("Error: Failed to load ROUTES_FILE: %v", err)
+		}
+		socks5conf.Dial = router.Dial
+	}
+	// Upstreams, routes and the SSH server resolve destination names
+	socks5conf.RemoteResolve = socks5conf.Dial != nil
+	if socks5conf.Dial != nil && (socks5conf.CommandEnabled(socks5.BindCommand) || socks5conf.CommandEnabled(socks5.AssociateCommand)) {
+		log.Println("Warning: BIND and UDP ASSOCIATE do not use UPSTREAM_PROXY, SSH_EGRESS_HOST or ROUTES_FILE and reach the network directly.")
+	}
+	outbound := cfg.OutboundIPv4 != "" || cfg.OutboundIPv6 != "" || cfg.OutboundInterface != "" || len(cfg.EgressAddresses) > 0
+	if outbound && (socks5conf.CommandEnabled(socks5.BindCommand) || socks5conf.CommandEnabled(socks5.AssociateCommand)) {
+		log.Println("Warning: OUTBOUND_IPV4, OUTBOUND_IPV6, OUTBOUND_INTERFACE and EGRESS_ADDRESSES only apply to CONNECT, BIND and UDP ASSOCIATE sockets use PROXY_BIND_IP.")
+	}
+
+	// Every enabled policy has to allow the request
+	socks5conf.Rules, err = newRules(cfg, userCommands)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 
 	server, err := socks5.New(socks5conf)
@@ -53,23 +285,70 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Set IP whitelist
+	// Set IP whitelist and blacklist of single IPs and CIDR prefixes,
+	// banned clients are refused as well
+	var whitelist *prefixTrie
 	if len(cfg.AllowedIPs) > 0 {
-		whitelist := make([]net.IP, len(cfg.AllowedIPs))
-		for i, ip := range cfg.AllowedIPs {
-			whitelist[i] = net.ParseIP(ip)
+		whitelist, err = newPrefixTrie(cfg.AllowedIPs)
+		if err != nil {
+			log.Fatalf("Error: ALLOWED_IPS: %v", err)
 		}
-		server.SetIPWhitelist(whitelist)
 	}
+	blacklist, err := newPrefixTrie(cfg.DeniedIPs)
+	if err != nil {
+		log.Fatalf("Error: DENIED_IPS: %v", err)
+	}
+	server.SetIPFilter(func(ip net.IP) bool {
+		if blacklist.ContainsIP(ip) || (bans != nil && bans.Banned(ip)) {
+			return false
+		}
+		return whitelist == nil || whitelist.ContainsIP(ip)
+	})
 
 	listenAddr := ":" + cfg.Port
 	if cfg.ListenIP != "" {
 		listenAddr = cfg.ListenIP + ":" + cfg.Port
 	}
 
+	// Serve HTTP proxy clients next to SOCKS ones
+	mux := &protocolMux{
+		socks:       server,
+		isIPAllowed: server.IsIPAllowed,
+		logger:      socks5conf.Logger,
+	}
+	if cfg.EnableHTTPProxy {
+		mux.http = &httpProxy{
+			config:      socks5conf,
+			credentials: creds,
+			clientCerts: clientCerts,
+			isIPAllowed: server.IsIPAllowed,
+			authFailed:  socks5conf.OnAuthFailure,
+		}
+	}
+
+	// TLS listener next to the plaintext one
+	if cfg.TLSPort != "" {
+		tlsConf, err := newTLSConfig(cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		tlsAddr := cfg.ListenIP + ":" + cfg.TLSPort
+		tl, err := tls.Listen("tcp", tlsAddr, tlsConf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Start listening TLS proxy service on %s\n", tlsAddr)
+		go func() {
+			log.Fatal(mux.Serve(tl))
+		}()
+	}
 
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Printf("Start listening proxy service on %s\n", listenAddr)
-	if err := server.ListenAndServe("tcp", listenAddr); err != nil {
+	if err := mux.Serve(l); err != nil {
 		log.Fatal(err)
 	}
 }
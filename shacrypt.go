@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt ($5$ and $6$) password hashes as specified by Ulrich Drepper,
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// shaCryptPermutations is the order the digest bytes are encoded in,
+// three bytes at a time
+var shaCryptPermutations = map[string][][3]int{
+	"5": {
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	},
+	"6": {
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	},
+}
+
+// verifySHACrypt checks a password against a $5$ or $6$ hash
+func verifySHACrypt(hashed, password string) (bool, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 && len(parts) != 5 {
+		return false, fmt.Errorf("malformed SHA-crypt hash")
+	}
+
+	id := parts[1]
+	var newHash func() hash.Hash
+	switch id {
+	case "5":
+		newHash = sha256.New
+	case "6":
+		newHash = sha512.New
+	default:
+		return false, fmt.Errorf("unknown SHA-crypt id %q", id)
+	}
+
+	rounds := shaCryptDefaultRounds
+	roundsCustom := false
+	salt := parts[2]
+	if len(parts) == 5 {
+		value, ok := strings.CutPrefix(parts[2], "rounds=")
+		if !ok {
+			return false, fmt.Errorf("malformed SHA-crypt rounds")
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return false, fmt.Errorf("malformed SHA-crypt rounds: %v", err)
+		}
+		rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		roundsCustom = true
+		salt = parts[3]
+	}
+
+	computed := shaCrypt(newHash, id, []byte(password), []byte(salt), rounds, roundsCustom)
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1, nil
+}
+
+// shaCrypt computes the full SHA-crypt string for the password and salt
+func shaCrypt(newHash func() hash.Hash, id string, password, salt []byte, rounds int, roundsCustom bool) string {
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+
+	// Digest B
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	digestB := h.Sum(nil)
+	size := len(digestB)
+
+	// Digest A
+	h = newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatBytes(digestB, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			h.Write(digestB)
+		} else {
+			h.Write(password)
+		}
+	}
+	digestA := h.Sum(nil)
+
+	// Byte sequence P
+	h = newHash()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	seqP := repeatBytes(h.Sum(nil), len(password))
+
+	// Byte sequence S
+	h = newHash()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		h.Write(salt)
+	}
+	seqS := repeatBytes(h.Sum(nil), len(salt))
+
+	// Rounds
+	digestC := digestA
+	for i := 0; i < rounds; i++ {
+		h = newHash()
+		if i%2 == 1 {
+			h.Write(seqP)
+		} else {
+			h.Write(digestC)
+		}
+		if i%3 != 0 {
+			h.Write(seqS)
+		}
+		if i%7 != 0 {
+			h.Write(seqP)
+		}
+		if i%2 == 1 {
+			h.Write(digestC)
+		} else {
+			h.Write(seqP)
+		}
+		digestC = h.Sum(nil)
+	}
+
+	// Encode the result
+	var b strings.Builder
+	b.WriteString("$" + id + "$")
+	if roundsCustom {
+		fmt.Fprintf(&b, "rounds=%d$", rounds)
+	}
+	b.Write(salt)
+	b.WriteString("$")
+	for _, p := range shaCryptPermutations[id] {
+		encodeCrypt64(&b, digestC[p[0]], digestC[p[1]], digestC[p[2]], 4)
+	}
+	if size == sha256.Size {
+		encodeCrypt64(&b, 0, digestC[31], digestC[30], 3)
+	} else {
+		encodeCrypt64(&b, 0, 0, digestC[63], 2)
+	}
+	return b.String()
+}
+
+// repeatBytes repeats b until it is n bytes long
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+// encodeCrypt64 writes n characters of the crypt base64 encoding of three bytes
+func encodeCrypt64(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		b.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
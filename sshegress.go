@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/context"
+)
+
+// sshEgress dials destinations through direct-tcpip channels of a
+// persistent SSH client connection, like ssh -D. The connection is
+// kept alive and opened again when it drops.
+type sshEgress struct {
+	addr      string
+	config    *ssh.ClientConfig
+	keepalive time.Duration
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// newSSHEgress builds the SSH egress from the app params
+func newSSHEgress(cfg params) (*sshEgress, error) {
+	if cfg.SSHEgressUser == "" || cfg.SSHEgressKeyFile == "" {
+		return nil, fmt.Errorf("SSH_EGRESS_USER and SSH_EGRESS_KEY_FILE are required")
+	}
+	key, err := os.ReadFile(cfg.SSHEgressKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.SSHEgressKeyFile, err)
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case cfg.SSHEgressKnownHosts != "":
+		if hostKeyCallback, err = knownhosts.New(cfg.SSHEgressKnownHosts); err != nil {
+			return nil, err
+		}
+	case cfg.SSHEgressInsecureHostKey:
+		log.Println("[WARN] ssh: SSH_EGRESS_INSECURE_HOST_KEY is set, the host key of the SSH server is not verified")
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, fmt.Errorf("SSH_EGRESS_KNOWN_HOSTS is required to verify the SSH server")
+	}
+
+	addr := cfg.SSHEgressHost
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return &sshEgress{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            cfg.SSHEgressUser,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         cfg.SSHEgressTimeout,
+		},
+		keepalive: cfg.SSHEgressKeepalive,
+	}, nil
+}
+
+// String returns the SSH server address with the user
+func (e *sshEgress) String() string {
+	return e.config.User + "@" + e.addr
+}
+
+// Dial opens a direct-tcpip channel to addr. When the SSH connection
+// turns out to be broken, it is opened again and the dial retried once.
+func (e *sshEgress) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("ssh %s: unsupported network %s", e, network)
+	}
+
+	for attempt := 0; ; attempt++ {
+		client, err := e.connect(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("ssh %s: %w: %v", e, socks5.ErrServerFailure, err)
+		}
+		conn, err := client.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		var openErr *ssh.OpenChannelError
+		switch {
+		case errors.As(err, &openErr) && openErr.Reason == ssh.Prohibited:
+			return nil, fmt.Errorf("ssh %s: %w: %v", e, socks5.ErrRuleFailure, err)
+		case errors.As(err, &openErr):
+			return nil, fmt.Errorf("ssh %s: %w: %v", e, socks5.ErrHostUnreachable, err)
+		case ctx.Err() != nil:
+			return nil, err
+		}
+
+		// The channel could not be opened, the connection is broken
+		e.drop(client)
+		if attempt > 0 {
+			return nil, fmt.Errorf("ssh %s: %w: %v", e, socks5.ErrServerFailure, err)
+		}
+	}
+}
+
+// connect returns the SSH client connection, opening it when needed.
+// The dial and handshake run without the lock, so a slow server does
+// not hold up requests once another dial has connected.
+func (e *sshEgress) connect(ctx context.Context) (*ssh.Client, error) {
+	e.mu.Lock()
+	client := e.client
+	e.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	dialer := &net.Dialer{Timeout: e.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	if e.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(e.config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, e.addr, e.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client = ssh.NewClient(c, chans, reqs)
+
+	// Keep the connection of a concurrent dial which got there first
+	e.mu.Lock()
+	if e.client != nil {
+		current := e.client
+		e.mu.Unlock()
+		client.Close()
+		return current, nil
+	}
+	e.client = client
+	e.mu.Unlock()
+	log.Printf("[INFO] ssh: Connected to %s", e)
+
+	go func() {
+		err := client.Wait()
+		if e.drop(client) {
+			log.Printf("[WARN] ssh: Connection to %s closed: %v", e, err)
+		}
+	}()
+	if e.keepalive > 0 {
+		go e.keepAlive(client)
+	}
+	return client, nil
+}
+
+// drop closes the client and forgets it when it is the current one,
+// reporting whether it was
+func (e *sshEgress) drop(client *ssh.Client) bool {
+	client.Close()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client != client {
+		return false
+	}
+	e.client = nil
+	return true
+}
+
+// keepAlive sends keepalive requests and drops the client when one
+// is not answered within the interval
+func (e *sshEgress) keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(e.keepalive)
+	defer ticker.Stop()
+	for range ticker.C {
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			done <- err
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(e.keepalive):
+			err = fmt.Errorf("keepalive timeout")
+		}
+		if err != nil {
+			if e.drop(client) {
+				log.Printf("[WARN] ssh: Connection to %s lost: %v", e, err)
+			}
+			return
+		}
+	}
+}
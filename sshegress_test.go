@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/context"
+)
+
+// sshServer serves direct-tcpip channels for the client key and
+// returns its address and host key with a function dropping the
+// open connections
+func sshServer(t *testing.T, clientKey ssh.PublicKey) (string, ssh.PublicKey, func()) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					var dest struct {
+						Host       string
+						Port       uint32
+						OriginHost string
+						OriginPort uint32
+					}
+					if newChan.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChan.ExtraData(), &dest) != nil {
+						newChan.Reject(ssh.Prohibited, "not allowed")
+						continue
+					}
+					target, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+					if err != nil {
+						newChan.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, chReqs, err := newChan.Accept()
+					if err != nil {
+						target.Close()
+						continue
+					}
+					go ssh.DiscardRequests(chReqs)
+					go func() {
+						defer ch.Close()
+						defer target.Close()
+						go io.Copy(target, ch)
+						io.Copy(ch, target)
+					}()
+				}
+			}()
+		}
+	}()
+
+	drop := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}
+	return l.Addr().String(), hostKey.PublicKey(), drop
+}
+
+func TestSSHEgress(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	clientKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	echo := echoServer(t)
+	addr, hostKey, drop := sshServer(t, clientKey)
+	cfg := params{
+		SSHEgressHost:    addr,
+		SSHEgressUser:    "egress",
+		SSHEgressKeyFile: keyFile,
+		SSHEgressTimeout: time.Second,
+	}
+
+	// The host key has to be verified, or explicitly ignored
+	if _, err := newSSHEgress(cfg); err == nil {
+		t.Fatalf("expected error without known hosts")
+	}
+	_, otherKey, _ := sshServer(t, clientKey)
+	cfg.SSHEgressKnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(cfg.SSHEgressKnownHosts, []byte(knownhosts.Line([]string{addr}, otherKey)+"\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	impostor, err := newSSHEgress(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := impostor.Dial(context.Background(), "tcp", echoServer(t).Addr().String()); !errors.Is(err, socks5.ErrServerFailure) {
+		t.Fatalf("got %v, want %v", err, socks5.ErrServerFailure)
+	}
+
+	if err := os.WriteFile(cfg.SSHEgressKnownHosts, []byte(knownhosts.Line([]string{addr}, hostKey)+"\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	egress, err := newSSHEgress(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ping := func() {
+		t.Helper()
+		conn, err := egress.Dial(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("bad echo %q: %v", buf, err)
+		}
+	}
+	ping()
+
+	// The connection is opened again after it drops
+	drop()
+	ping()
+
+	// A closed port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	closed.Close()
+	if _, err := egress.Dial(context.Background(), "tcp", closed.Addr().String()); !errors.Is(err, socks5.ErrHostUnreachable) {
+		t.Errorf("got %v, want %v", err, socks5.ErrHostUnreachable)
+	}
+}
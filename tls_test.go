@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+)
+
+// serveTLSHandshakes completes the handshake of every connection
+func serveTLSHandshakes(t *testing.T, conf *tls.Config) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serverSerial returns the serial number of the certificate served at addr
+func serverSerial(t *testing.T, addr string, conf *tls.Config) string {
+	conn, err := tls.Dial("tcp", addr, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+}
+
+func TestTLSCertReload(t *testing.T) {
+	interval := reloadInterval
+	reloadInterval = 20 * time.Millisecond
+	t.Cleanup(func() { reloadInterval = interval })
+
+	ca := newTestCA(t)
+	cfg := params{TLSMinVersion: "1.2"}
+	writeTLSFiles(t, ca, &cfg)
+	conf, err := newTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := serveTLSHandshakes(t, conf)
+	client := ca.clientTLS(t, "")
+
+	first := serverSerial(t, addr, client)
+	certPEM, keyPEM := ca.issue(t, "server", true)
+	if err := os.WriteFile(cfg.TLSKeyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(cfg.TLSCertFile, certPEM, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// New handshakes get the new certificate once the change is seen
+	deadline := time.Now().Add(2 * time.Second)
+	for serverSerial(t, addr, client) == first {
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := params{TLSMinVersion: "1.3"}
+	writeTLSFiles(t, ca, &cfg)
+	conf, err := newTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := serveTLSHandshakes(t, conf)
+
+	client := ca.clientTLS(t, "")
+	client.MaxVersion = tls.VersionTLS12
+	if conn, err := tls.Dial("tcp", addr, client); err == nil {
+		conn.Close()
+		t.Fatalf("TLS 1.2 handshake accepted")
+	}
+	client.MaxVersion = tls.VersionTLS13
+	conn, err := tls.Dial("tcp", addr, client)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	cfg.TLSMinVersion = "1.4"
+	if _, err := newTLSConfig(cfg); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/serjs/socks5-server/go-socks5"
+	"golang.org/x/net/context"
+)
+
+// echoServer accepts connections and echoes what it reads
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// serveUpstream serves the proxy protocol mux on a local listener
+func serveUpstream(t *testing.T, conf *socks5.Config) string {
+	conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	server, err := socks5.New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mux := &protocolMux{
+		socks:       server,
+		http:        &httpProxy{config: conf, credentials: conf.Credentials, isIPAllowed: server.IsIPAllowed, authFailed: conf.OnAuthFailure},
+		isIPAllowed: server.IsIPAllowed,
+		logger:      conf.Logger,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go mux.Serve(l)
+	return l.Addr().String()
+}
+
+func TestUpstream(t *testing.T) {
+	echo := echoServer(t)
+	proxy := serveUpstream(t, &socks5.Config{Credentials: socks5.StaticCredentials{"foo": "bar"}})
+	strict := serveUpstream(t, &socks5.Config{Rules: socks5.PermitNone()})
+
+	// A closed port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	closed.Close()
+
+	for _, tc := range []struct {
+		url  string
+		dest string
+		err  error
+	}{
+		{"socks5://foo:bar@" + proxy, echo.Addr().String(), nil},
+		{"http://foo:bar@" + proxy, echo.Addr().String(), nil},
+		{"socks5://foo:bar@" + proxy, closed.Addr().String(), socks5.ErrConnectionRefused},
+		{"socks5://foo:baz@" + proxy, echo.Addr().String(), socks5.ErrServerFailure},
+		{"socks5://" + strict, echo.Addr().String(), socks5.ErrRuleFailure},
+		{"http://" + strict, echo.Addr().String(), socks5.ErrRuleFailure},
+		{"socks5://" + closed.Addr().String(), echo.Addr().String(), socks5.ErrServerFailure},
+	} {
+		up, err := newUpstream(tc.url, time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn, err := up.Dial(context.Background(), "tcp", tc.dest)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s to %s: got %v, want %v", up, tc.dest, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: err: %v", up, err)
+		}
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("%s: bad echo %q: %v", up, buf, err)
+		}
+		conn.Close()
+	}
+
+	if _, err := newUpstream("ftp://host", time.Second); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// hostsResolver resolves the names of the map, others fail
+type hostsResolver map[string]net.IP
+
+func (r hostsResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ip, ok := r[name]
+	if !ok {
+		return ctx, nil, fmt.Errorf("lookup %s: no such host", name)
+	}
+	return ctx, ip, nil
+}
+
+func TestUpstreamRemoteResolve(t *testing.T) {
+	echo := echoServer(t)
+	port := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	// The name only resolves at the upstream
+	upstreamAddr := serveUpstream(t, &socks5.Config{Resolver: hostsResolver{"internal.test": net.IPv4(127, 0, 0, 1)}})
+	for _, scheme := range []string{"socks5h", "http"} {
+		up, err := newUpstream(scheme+"://"+upstreamAddr, time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		front := serveUpstream(t, &socks5.Config{Dial: up.Dial, RemoteResolve: true, Resolver: hostsResolver{}})
+
+		for _, clientScheme := range []string{"socks5h", "http"} {
+			client, err := newUpstream(clientScheme+"://"+front, time.Second)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			conn, err := client.Dial(context.Background(), "tcp", "internal.test:"+port)
+			if err != nil {
+				t.Fatalf("%s via %s: err: %v", client, up, err)
+			}
+			conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("%s via %s: bad echo %q: %v", client, up, buf, err)
+			}
+			conn.Close()
+		}
+	}
+
+	// When the rules check the destination IP, the checked IP is dialed
+	// and the upstream does not resolve the name again
+	policy, err := newDestPolicy(params{DeniedDestIPs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, scheme := range []string{"socks5h", "http"} {
+		up, err := newUpstream(scheme+"://"+upstreamAddr, time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		front := serveUpstream(t, &socks5.Config{Dial: up.Dial, RemoteResolve: true, Rules: policy,
+			Resolver: hostsResolver{"checked.test": net.IPv4(127, 0, 0, 1)}})
+		client, err := newUpstream("socks5h://"+front, time.Second)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn, err := client.Dial(context.Background(), "tcp", "checked.test:"+port)
+		if err != nil {
+			t.Fatalf("via %s: err: %v", up, err)
+		}
+		conn.Close()
+	}
+
+	// socks5:// resolves locally
+	up, err := newUpstream("socks5://"+upstreamAddr, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx := socks5.WithConfig(context.Background(), &socks5.Config{Resolver: hostsResolver{}})
+	if _, err := up.Dial(ctx, "tcp", "internal.test:"+port); !errors.Is(err, socks5.ErrHostUnreachable) {
+		t.Fatalf("got %v, want %v", err, socks5.ErrHostUnreachable)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// reloadInterval is how often watched files are checked for changes,
+// set from RELOAD_INTERVAL
+var reloadInterval = 10 * time.Second
+
+// watchFiles calls onChange every time one of the files is modified,
+// replaced or removed. Changes are detected by polling the file metadata.
+func watchFiles(onChange func(), paths ...string) {
+	stat := func() []os.FileInfo {
+		infos := make([]os.FileInfo, len(paths))
+		for i, path := range paths {
+			infos[i], _ = os.Stat(path)
+		}
+		return infos
+	}
+
+	last := stat()
+	ticker := time.NewTicker(reloadInterval)
+	go func() {
+		for range ticker.C {
+			current := stat()
+			if changed(last, current) {
+				onChange()
+			}
+			last = current
+		}
+	}()
+}
+
+func changed(last, current []os.FileInfo) bool {
+	for i := range last {
+		if (last[i] == nil) != (current[i] == nil) {
+			return true
+		}
+		if last[i] == nil {
+			continue
+		}
+		if !last[i].ModTime().Equal(current[i].ModTime()) || last[i].Size() != current[i].Size() {
+			return true
+		}
+	}
+	return false
+}